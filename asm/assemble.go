@@ -21,6 +21,9 @@ const (
 	ARG_IMMEDIATE
 )
 
+// Maximum number of command arguments
+const MAX_ARGS = int(vm.MAX_CMD_ARGS)
+
 var (
 	argMap = map[uint16]map[int]uint16{
 		vm.FLAG_NONE: map[int]uint16{
@@ -44,31 +47,51 @@ var (
 			ARG_ADDRESS:   vm.FLAG_AA,
 		},
 	}
+	// registerOperands marks the arguments holding register addresses for each flag.
+	registerOperands = map[uint16][MAX_ARGS]bool{
+		vm.FLAG_R:  {true, false},
+		vm.FLAG_A:  {true, false},
+		vm.FLAG_RR: {true, true},
+		vm.FLAG_RI: {true, false},
+		vm.FLAG_RA: {true, true},
+		vm.FLAG_AR: {true, true},
+		vm.FLAG_AI: {true, false},
+		vm.FLAG_AA: {true, true},
+		vm.FLAG_IR: {false, true},
+		vm.FLAG_IA: {false, true},
+	}
 	commandMap = map[string]uint16{
-		"ADD":  vm.CMD_ADD,
-		"SUB":  vm.CMD_SUB,
-		"MUL":  vm.CMD_MUL,
-		"DIV":  vm.CMD_DIV,
-		"INC":  vm.CMD_INC,
-		"DEC":  vm.CMD_DEC,
-		"AND":  vm.CMD_AND,
-		"OR":   vm.CMD_OR,
-		"XOR":  vm.CMD_XOR,
-		"NOT":  vm.CMD_NOT,
-		"SHL":  vm.CMD_SHL,
-		"SHR":  vm.CMD_SHR,
-		"MOV":  vm.CMD_MOV,
-		"PUSH": vm.CMD_PUSH,
-		"POP":  vm.CMD_POP,
-		"CMP":  vm.CMD_CMP,
-		"CNT":  vm.CMD_CNT,
-		"LGE":  vm.CMD_LGE,
-		"SME":  vm.CMD_SME,
-		"JIF":  vm.CMD_JIF,
-		"JMP":  vm.CMD_JMP,
-		"CALL": vm.CMD_CALL,
-		"RET":  vm.CMD_RET,
-		"HLT":  vm.CMD_HLT,
+		"ADD":     vm.CMD_ADD,
+		"SUB":     vm.CMD_SUB,
+		"MUL":     vm.CMD_MUL,
+		"DIV":     vm.CMD_DIV,
+		"INC":     vm.CMD_INC,
+		"DEC":     vm.CMD_DEC,
+		"AND":     vm.CMD_AND,
+		"OR":      vm.CMD_OR,
+		"XOR":     vm.CMD_XOR,
+		"NOT":     vm.CMD_NOT,
+		"SHL":     vm.CMD_SHL,
+		"SHR":     vm.CMD_SHR,
+		"MOV":     vm.CMD_MOV,
+		"PUSH":    vm.CMD_PUSH,
+		"POP":     vm.CMD_POP,
+		"CMP":     vm.CMD_CMP,
+		"CNT":     vm.CMD_CNT,
+		"LGE":     vm.CMD_LGE,
+		"SME":     vm.CMD_SME,
+		"JIF":     vm.CMD_JIF,
+		"JMP":     vm.CMD_JMP,
+		"CALL":    vm.CMD_CALL,
+		"RET":     vm.CMD_RET,
+		"IRET":    vm.CMD_IRET,
+		"HLT":     vm.CMD_HLT,
+		"BRK":     vm.CMD_BRK,
+		"CPUID":   vm.CMD_CPUID,
+		"XCHG":    vm.CMD_XCHG,
+		"CMPXCHG": vm.CMD_CMPXCHG,
+		"PROT":    vm.CMD_PROT,
+		"SPT":     vm.CMD_SPT,
 	}
 	registerMap = map[string]uint16{
 		"AX":  vm.REGISTER_AX,
@@ -79,35 +102,138 @@ var (
 		"IRS": vm.IR_STATE,
 		"IRK": vm.IR_KEYBOARD,
 		"IRO": vm.IR_OVERFLOW,
+		"IRT": vm.IR_TIMER,
+		"IRD": vm.IR_DOUBLE,
+		"IRP": vm.IR_PROTECTION,
+		"IRG": vm.IR_PAGE,
+		"IRB": vm.IR_BASE,
+		"IRM": vm.IR_MASK,
+		"IRF": vm.IR_FAULT,
+		"KD":  vm.KEY_DATA,
+		"KM":  vm.KEY_MODIFIERS,
+		"TC":  vm.TIMER_CONTROL,
+		"TP":  vm.TIMER_PERIOD,
+		"TT":  vm.TIMER_TICKS,
+		"BS":  vm.BANK_SELECT,
+		"NC":  vm.NVRAM_CONTROL,
 		"SB":  vm.STACK_BASE,
 		"CP":  vm.CODE_POINTER,
 		"SP":  vm.STACK_POINTER,
 		"ZF":  vm.ZERO_FLAG,
 		"CF":  vm.CARRY_FLAG,
 	}
+	// Interrupt vector names, resolved against the vector table of a layout
+	vectorNames = map[string]uint16{
+		"IRS": vm.VECTOR_STATE,
+		"IRK": vm.VECTOR_KEYBOARD,
+		"IRO": vm.VECTOR_OVERFLOW,
+		"IRT": vm.VECTOR_TIMER,
+		"IRD": vm.VECTOR_DOUBLE,
+		"IRP": vm.VECTOR_PROTECTION,
+		"IRG": vm.VECTOR_PAGE,
+	}
+	relativeCommands = map[string]bool{
+		"JMP":  true,
+		"JIF":  true,
+		"CALL": true,
+	}
 	systemPointers = map[string]uint16{
 		"SM":  vm.STACK_MAX,
 		"OCH": vm.OUT_CHARS,
 		"OCL": vm.OUT_COLORS,
 		"CB":  vm.CODE_BASE,
 		"OMD": vm.OUT_MODE,
+		"SYS": vm.SYSTEM_INFO,
 	}
 	pointerRegex, _ = regexp.Compile("[a-zA-Z]+")
 	numberRegex, _  = regexp.Compile("((0x[0-9a-fA-F]+)|(0[0-7]+)|([0-9]+))")
 )
 
 // PointerReference represents a assembler reference to a point in memory.
+// Relative references are resolved as offsets from the end of the referencing line.
 type PointerReference struct {
 	Name      string
 	Line, Arg int
+	Relative  bool
 }
 
-// Assemble generates bytecode from GOVM ASM.
+// Assemble generates bytecode from GOVM ASM based at vm.CODE_BASE.
 func Assemble(code string) []byte {
+	return AssembleAt(code, vm.CODE_BASE)
+}
+
+// AssembleAt generates bytecode from GOVM ASM based at the given address.
+// Jumps and calls to labels are encoded PC-relative, so programs
+// without absolute label references can be loaded at any address.
+func AssembleAt(code string, base uint16) []byte {
+	return encode(AssembleImage(code, base, false))
+}
+
+// AssembleCompact generates compact ISA v2 bytecode from GOVM ASM based at vm.CODE_BASE.
+func AssembleCompact(code string) []byte {
+	return AssembleCompactAt(code, vm.CODE_BASE)
+}
+
+// AssembleCompactAt generates compact ISA v2 bytecode from GOVM ASM based at the given address.
+// The output starts with a header selecting the compact encoding.
+func AssembleCompactAt(code string, base uint16) []byte {
+	return encode(AssembleImage(code, base, true))
+}
+
+// encode converts an image into raw bytecode.
+// Programs using banks are emitted as blocks behind a header.
+func encode(image vm.Image) []byte {
+	data, _ := vm.EncodeImage(image, vm.FORMAT_RAW)
+	return data
+}
+
+// AssembleImage generates a program image from GOVM ASM based at the given address,
+// which can be exported in any vm.Format.
+// The BANK directive places the following lines into a bank, based at
+// vm.BANK_WINDOW or the given window address.
+func AssembleImage(code string, base uint16, compact bool) vm.Image {
+	return assembleImage(code, base, compact, registerMap, systemPointers)
+}
+
+// AssembleLayout generates a program image for a machine with the given layout, based at its code base.
+// The names of the stack, display, code base and interrupt vectors refer to the regions of the layout.
+func AssembleLayout(code string, layout vm.Layout, compact bool) vm.Image {
+	registers, pointers := layoutNames(layout)
+	return assembleImage(code, layout.CodeBase, compact, registers, pointers)
+}
+
+// layoutNames returns the register and pointer names with the addresses of a layout.
+func layoutNames(layout vm.Layout) (map[string]uint16, map[string]uint16) {
+	registers := make(map[string]uint16, len(registerMap))
+	for name, addr := range registerMap {
+		registers[name] = addr
+	}
+	for name, vector := range vectorNames {
+		registers[name] = layout.Vectors + vector*vm.WORD_SIZE
+	}
+	registers["SB"] = layout.StackBase
+	pointers := make(map[string]uint16, len(systemPointers))
+	for name, addr := range systemPointers {
+		pointers[name] = addr
+	}
+	pointers["SM"] = layout.StackMax
+	pointers["OCH"] = layout.Display
+	pointers["OCL"] = layout.Display + vm.OUT_COLORS - vm.OUT_CHARS
+	pointers["OMD"] = layout.Display + vm.OUT_MODE - vm.OUT_CHARS
+	pointers["CB"] = layout.CodeBase
+	return registers, pointers
+}
+
+// assembleImage generates a program image resolving names through the given maps.
+func assembleImage(code string, base uint16, compact bool, registers, pointers map[string]uint16) vm.Image {
 	var references []PointerReference
 	var lineBuffer [][]uint16
 	var lineDebug []string
+	var lineSections []int
+	sections := []vm.Block{{Bank: vm.BANK_NONE, Address: base}}
+	dataLines := make(map[int]bool)
 	definedPointers := make(map[string]uint16)
+	labelSections := make(map[string]int)
 	cleanLines := CleanCode(code)
 
 	// Build bytecode as normal
@@ -119,7 +245,9 @@ func Assemble(code string) []byte {
 
 		// Handle marker
 		if strings.HasSuffix(active, ":") {
-			definedPointers[strings.TrimRight(active, ":")] = uint16(len(lineBuffer))
+			name := strings.TrimRight(active, ":")
+			definedPointers[name] = uint16(len(lineBuffer))
+			labelSections[name] = len(sections) - 1
 			continue
 		}
 
@@ -127,58 +255,151 @@ func Assemble(code string) []byte {
 		cmd := strings.ToUpper(tokens[0])
 		var result []uint16
 		switch cmd {
+		case "BANK":
+			section := vm.Block{Bank: ParseNumber(tokens[1]), Address: vm.BANK_WINDOW}
+			if len(tokens) > 2 {
+				section.Address = ParseNumber(tokens[2])
+			}
+			sections = append(sections, section)
+			continue
 		case "DB":
 			if strings.HasPrefix(tokens[1], "\"") {
 				result = ParseString(active[3:])
 			} else {
 				result = []uint16{ParseNumber(active[3:])}
 			}
+			dataLines[len(lineBuffer)] = true
 		default:
-			data, refs := ParseCommand(tokens, len(lineBuffer))
+			data, refs := parseCommand(tokens, len(lineBuffer), registers, pointers)
 			result = data
 			references = append(references, refs...)
 		}
 		lineBuffer = append(lineBuffer, result)
 		lineDebug = append(lineDebug, active)
+		lineSections = append(lineSections, len(sections)-1)
+	}
+
+	// Referenced arguments keep their full size, so line sizes are known before resolving
+	fixedArgs := make([][MAX_ARGS]bool, len(lineBuffer))
+	for _, p := range references {
+		fixedArgs[p.Line][p.Arg] = true
+	}
+	encodeLine := func(index int) []byte {
+		if compact && !dataLines[index] {
+			return EncodeCompact(lineBuffer[index], fixedArgs[index])
+		}
+		return EncodeWords(lineBuffer[index])
 	}
 
 	mappedBytes := make([]uint16, 0)
-	byteCount := uint16(0)
-	for _, line := range lineBuffer {
-		mappedBytes = append(mappedBytes, byteCount)
-		byteCount += uint16(len(line) * 2)
+	lineSizes := make([]uint16, 0)
+	byteCounts := make([]uint16, len(sections))
+	for index := range lineBuffer {
+		size := uint16(len(encodeLine(index)))
+		section := lineSections[index]
+		mappedBytes = append(mappedBytes, sections[section].Address+byteCounts[section])
+		lineSizes = append(lineSizes, size)
+		byteCounts[section] += size
 	}
 
 	for name, ptr := range definedPointers {
-		definedPointers[name] = mappedBytes[ptr] + vm.CODE_BASE
+		section := labelSections[name]
+		if int(ptr) < len(mappedBytes) && lineSections[ptr] == section {
+			definedPointers[name] = mappedBytes[ptr]
+		} else {
+			// Labels at the end of a section point behind its last line
+			definedPointers[name] = sections[section].Address + byteCounts[section]
+		}
 	}
 
 	for _, p := range references {
-		if _, ok := definedPointers[p.Name]; !ok {
+		target, ok := definedPointers[p.Name]
+		if !ok {
 			fmt.Printf("ERROR: Missing pointer %s\n", p.Name)
-			return []byte{}
+			return vm.Image{Entry: base, Compact: compact}
+		}
+		switch {
+		case p.Relative && labelSections[p.Name] == lineSections[p.Line]:
+			target -= mappedBytes[p.Line] + lineSizes[p.Line]
+		case p.Relative:
+			// Targets in other banks are only reachable by absolute address
+			lineBuffer[p.Line][0] = lineBuffer[p.Line][0]&^vm.FLAG_MASK | vm.FLAG_I
 		}
-		lineBuffer[p.Line][p.Arg+1] = definedPointers[p.Name]
+		lineBuffer[p.Line][p.Arg+1] = target
 	}
 
 	for index, command := range lineDebug {
-		fmt.Printf("%4.4X %-24s %4.4X\n", mappedBytes[index]+vm.CODE_BASE, command, lineBuffer[index])
+		data := encodeLine(index)
+		if compact {
+			fmt.Printf("%4.4X %-24s % X\n", mappedBytes[index], command, data)
+		} else {
+			fmt.Printf("%4.4X %-24s %4.4X\n", mappedBytes[index], command, lineBuffer[index])
+		}
+		section := &sections[lineSections[index]]
+		section.Data = append(section.Data, data...)
 	}
 
-	var output []byte
-	for _, line := range lineBuffer {
-		data := make([]byte, len(line)*2)
-		for i, e := range line {
-			vm.ByteOrder.PutUint16(data[i*2:i*2+2], e)
+	return vm.Image{Blocks: sections, Entry: base, Compact: compact}
+}
+
+// EncodeWords converts a slice of words into bytes.
+func EncodeWords(words []uint16) []byte {
+	data := make([]byte, len(words)*2)
+	for i, e := range words {
+		vm.ByteOrder.PutUint16(data[i*2:i*2+2], e)
+	}
+	return data
+}
+
+// EncodeCompact converts a standard encoded command into the compact encoding.
+// Fixed arguments are always stored as full words, only register operands use the packed register form.
+func EncodeCompact(line []uint16, fixed [MAX_ARGS]bool) []byte {
+	if len(line) == 0 {
+		return []byte{}
+	}
+	operands := registerOperands[line[0]&vm.FLAG_MASK]
+	var forms [MAX_ARGS]uint16
+	var registers byte
+	hasRegisters := false
+	for i, arg := range line[1:] {
+		switch {
+		case fixed[i]:
+			forms[i] = vm.COMPACT_WORD
+		case operands[i] && arg%vm.WORD_SIZE == 0 && arg <= 0xF*vm.WORD_SIZE:
+			forms[i] = vm.COMPACT_REGISTER
+			registers |= byte(arg/vm.WORD_SIZE) << uint(4-4*i)
+			hasRegisters = true
+		case int16(arg) >= -128 && int16(arg) <= 127:
+			forms[i] = vm.COMPACT_SHORT
+		default:
+			forms[i] = vm.COMPACT_WORD
 		}
-		output = append(output, data...)
 	}
 
-	return output
+	flag := line[0] & vm.FLAG_MASK
+	mode := byte(flag>>4) | byte(forms[0]<<2) | byte(forms[1])
+	data := []byte{byte(line[0] & vm.CMD_MASK), mode}
+	if hasRegisters {
+		data = append(data, registers)
+	}
+	for i, arg := range line[1:] {
+		switch forms[i] {
+		case vm.COMPACT_SHORT:
+			data = append(data, byte(arg))
+		case vm.COMPACT_WORD:
+			data = append(data, byte(arg>>8), byte(arg))
+		}
+	}
+	return data
 }
 
 // ParseCommand parses a specific command and returns a word representation and a slice of pointers.
 func ParseCommand(args []string, line int) ([]uint16, []PointerReference) {
+	return parseCommand(args, line, registerMap, systemPointers)
+}
+
+// parseCommand parses a command resolving register and pointer names through the given maps.
+func parseCommand(args []string, line int, registers, names map[string]uint16) ([]uint16, []PointerReference) {
 	cmdMap, ok := commandMap[args[0]]
 	if !ok {
 		fmt.Printf("ERROR: Unknown command %s\n", args[0])
@@ -200,16 +421,17 @@ func ParseCommand(args []string, line int) ([]uint16, []PointerReference) {
 			argValue = ParseNumber(arg)
 			argType = ARG_IMMEDIATE
 		} else if pointerRegex.MatchString(arg) {
-			if v, ok := registerMap[arg]; ok {
+			if v, ok := registers[arg]; ok {
 				if argType == ARG_NONE {
 					argType = ARG_REGISTER
 				}
 				argValue = v
-			} else if v, ok := systemPointers[arg]; ok {
+			} else if v, ok := names[arg]; ok {
 				argValue = v
 				argType = ARG_IMMEDIATE
 			} else {
-				pointers = append(pointers, PointerReference{arg, line, index})
+				relative := relativeCommands[args[0]] && argType == ARG_NONE
+				pointers = append(pointers, PointerReference{arg, line, index, relative})
 				argType = ARG_IMMEDIATE
 			}
 		}
@@ -217,6 +439,9 @@ func ParseCommand(args []string, line int) ([]uint16, []PointerReference) {
 		cmd = append(cmd, argValue)
 		flag = argMap[flag][argType]
 	}
+	if len(pointers) == 1 && pointers[0].Relative {
+		flag = vm.FLAG_P
+	}
 
 	cmd[0] = cmd[0] | flag
 	return cmd, pointers
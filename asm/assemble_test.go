@@ -0,0 +1,162 @@
+package asm
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/lnsp/go-vm/vm"
+)
+
+// silentDisplay runs assembled programs without a terminal.
+type silentDisplay struct{}
+
+func (silentDisplay) Draw(width, height int, data []byte) {}
+func (silentDisplay) Init() error                         { return nil }
+func (silentDisplay) Close()                              {}
+
+// bytecode serializes command words as bytecode.
+func bytecode(words ...uint16) []byte {
+	code := make([]byte, 2*len(words))
+	for i, word := range words {
+		vm.ByteOrder.PutUint16(code[2*i:], word)
+	}
+	return code
+}
+
+func TestEncodeCompact(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		line  []uint16
+		fixed [MAX_ARGS]bool
+		want  []byte
+	}{
+		{"ADD AX BX", []uint16{vm.FLAG_RR | vm.CMD_ADD, vm.REGISTER_AX, vm.REGISTER_BX}, [MAX_ARGS]bool{}, []byte{0x01, 0x15, 0x45}},
+		{"ADD AX 4", []uint16{vm.FLAG_RI | vm.CMD_ADD, vm.REGISTER_AX, 4}, [MAX_ARGS]bool{}, []byte{0x01, 0x26, 0x40, 0x04}},
+		{"ADD AX 0x1E", []uint16{vm.FLAG_RI | vm.CMD_ADD, vm.REGISTER_AX, 0x1E}, [MAX_ARGS]bool{}, []byte{0x01, 0x26, 0x40, 0x1E}},
+		{"ADD AX [BX]", []uint16{vm.FLAG_RA | vm.CMD_ADD, vm.REGISTER_AX, vm.REGISTER_BX}, [MAX_ARGS]bool{}, []byte{0x01, 0x35, 0x45}},
+		{"PUSH 4", []uint16{vm.FLAG_I | vm.CMD_PUSH, 4}, [MAX_ARGS]bool{}, []byte{0x0E, 0x88, 0x04}},
+		{"ADD AX 0x20", []uint16{vm.FLAG_RI | vm.CMD_ADD, vm.REGISTER_AX, 0x20}, [MAX_ARGS]bool{}, []byte{0x01, 0x26, 0x40, 0x20}},
+		{"ADD AX 3", []uint16{vm.FLAG_RI | vm.CMD_ADD, vm.REGISTER_AX, 3}, [MAX_ARGS]bool{}, []byte{0x01, 0x26, 0x40, 0x03}},
+		{"ADD AX -2", []uint16{vm.FLAG_RI | vm.CMD_ADD, vm.REGISTER_AX, 0xFFFE}, [MAX_ARGS]bool{}, []byte{0x01, 0x26, 0x40, 0xFE}},
+		{"ADD AX label", []uint16{vm.FLAG_RI | vm.CMD_ADD, vm.REGISTER_AX, 4}, [MAX_ARGS]bool{false, true}, []byte{0x01, 0x27, 0x40, 0x00, 0x04}},
+		{"MOV 6 [0x3000]", []uint16{vm.FLAG_IA | vm.CMD_MOV, 6, 0x3000}, [MAX_ARGS]bool{}, []byte{0x0D, 0x6B, 0x06, 0x30, 0x00}},
+		{"HLT", []uint16{vm.CMD_HLT}, [MAX_ARGS]bool{}, []byte{0x16, 0x00}},
+	} {
+		if got := EncodeCompact(c.line, c.fixed); !bytes.Equal(got, c.want) {
+			t.Errorf("EncodeCompact(%s) = % X, want % X", c.name, got, c.want)
+		}
+	}
+}
+
+func TestRelativeJumps(t *testing.T) {
+	for _, c := range []struct {
+		code              string
+		standard, compact []byte
+	}{
+		{"JMP end\nINC AX\nend:\nHLT",
+			bytecode(vm.FLAG_P|vm.CMD_JMP, 4, vm.FLAG_R|vm.CMD_INC, vm.REGISTER_AX, vm.CMD_HLT),
+			[]byte{0x13, 0xDC, 0x00, 0x03, 0x05, 0x94, 0x40, 0x16, 0x00}},
+		{"start:\nINC AX\nCMP AX 3\nJIF start\nHLT",
+			bytecode(vm.FLAG_R|vm.CMD_INC, vm.REGISTER_AX, vm.FLAG_RI|vm.CMD_CMP, vm.REGISTER_AX, 3, vm.FLAG_P|vm.CMD_JIF, 0xFFF2, vm.CMD_HLT),
+			[]byte{0x05, 0x94, 0x40, 0x10, 0x26, 0x40, 0x03, 0x12, 0xDC, 0xFF, 0xF5, 0x16, 0x00}},
+		{"CALL f\nHLT\nf:\nRET",
+			bytecode(vm.FLAG_P|vm.CMD_CALL, 2, vm.CMD_HLT, vm.CMD_RET),
+			[]byte{0x14, 0xDC, 0x00, 0x02, 0x16, 0x00, 0x15, 0x00}},
+		{"JMP [end]\nend:\nHLT",
+			bytecode(vm.FLAG_I|vm.CMD_JMP, vm.CODE_BASE+4, vm.CMD_HLT),
+			[]byte{0x13, 0x8C, 0x20, 0x04, 0x16, 0x00}},
+	} {
+		if got := AssembleAt(c.code, vm.CODE_BASE); !bytes.Equal(got, c.standard) {
+			t.Errorf("%q = % X, want % X", c.code, got, c.standard)
+		}
+		if got := AssembleCompactAt(c.code, vm.CODE_BASE)[vm.HEADER_SIZE:]; !bytes.Equal(got, c.compact) {
+			t.Errorf("%q compact = % X, want % X", c.code, got, c.compact)
+		}
+	}
+	// Relative code does not depend on its base, absolute targets do
+	if a, b := AssembleAt("start:\nJMP start", vm.CODE_BASE), AssembleAt("start:\nJMP start", 0x4000); !bytes.Equal(a, b) {
+		t.Errorf("relative jump differs between bases: % X, % X", a, b)
+	}
+	if a, b := AssembleAt("start:\nJMP [start]", vm.CODE_BASE), AssembleAt("start:\nJMP [start]", 0x4000); bytes.Equal(a, b) {
+		t.Errorf("absolute jump does not depend on the base: % X", a)
+	}
+}
+
+func TestBankDirective(t *testing.T) {
+	code := AssembleAt("MOV 1 BS\nCALL far\nHLT\nBANK 1\nfar:\nINC AX\nRET\nBANK 2 0xA000\nDB 7", vm.CODE_BASE)
+	if len(code) < int(vm.HEADER_SIZE) || vm.ByteOrder.Uint16(code) != vm.HEADER_MAGIC || vm.ByteOrder.Uint16(code[2:]) != vm.HEADER_BLOCKS {
+		t.Fatalf("missing block header: % X", code)
+	}
+	blocks, err := vm.DecodeBlocks(code[vm.HEADER_SIZE:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []vm.Block{
+		// calls into other banks use absolute addresses
+		{Bank: vm.BANK_NONE, Address: vm.CODE_BASE, Data: bytecode(vm.FLAG_IR|vm.CMD_MOV, 1, vm.BANK_SELECT, vm.FLAG_I|vm.CMD_CALL, vm.BANK_WINDOW, vm.CMD_HLT)},
+		{Bank: 1, Address: vm.BANK_WINDOW, Data: bytecode(vm.FLAG_R|vm.CMD_INC, vm.REGISTER_AX, vm.CMD_RET)},
+		{Bank: 2, Address: 0xA000, Data: bytecode(7)},
+	}
+	if len(blocks) != len(want) {
+		t.Fatalf("blocks = %v", blocks)
+	}
+	for i, block := range blocks {
+		if block.Bank != want[i].Bank || block.Address != want[i].Address || !bytes.Equal(block.Data, want[i].Data) {
+			t.Errorf("block %d = %04X %04X % X, want %04X %04X % X", i,
+				block.Bank, block.Address, block.Data, want[i].Bank, want[i].Address, want[i].Data)
+		}
+	}
+}
+
+func TestCompactRoundTrip(t *testing.T) {
+	for _, code := range []string{
+		"MOV 3 AX\nMOV 4 BX\nCALL add\nHLT\nadd:\nADD AX BX\nRET",
+		"MOV 0x1234 CX\nSUB CX 0x200\nstart:\nINC AX\nADD BX 6\nCMP DX 5\nINC DX\nJIF start\nHLT",
+		"PUSH 0xFFFE\nPOP AX\nMOV AX BX\nSHR BX 1\nXOR DX BX\nMOV 7 CX\nMUL CX 0x20\nHLT",
+	} {
+		var want [4]uint16
+		for i, assemble := range []func(string, uint16) []byte{AssembleAt, AssembleCompactAt} {
+			for _, base := range []uint16{vm.CODE_BASE, 0x4000} {
+				machine := vm.New()
+				machine.SetDisplay(silentDisplay{})
+				if err := machine.BootAt(assemble(code, base), base); err != nil {
+					t.Fatalf("%q: %v", code, err)
+				}
+				var got [4]uint16
+				for j, register := range []uint16{vm.REGISTER_AX, vm.REGISTER_BX, vm.REGISTER_CX, vm.REGISTER_DX} {
+					got[j], _ = machine.Load(register)
+				}
+				if i == 0 && base == vm.CODE_BASE {
+					want = got
+				} else if got != want {
+					t.Errorf("%q (encoding %d at %04X): registers %04X, want %04X", code, i, base, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestAssembleLayout(t *testing.T) {
+	layout := vm.DefaultLayout
+	layout.CodeBase = 0x4000
+	layout.StackBase, layout.StackMax = 0x3000, 0x30FF
+	layout.Display = 0x5000
+	layout.Vectors = 0x0200
+	image := AssembleLayout("MOV OCH AX\nMOV SB BX\nMOV IRK CX\nMOV CB DX\nHLT", layout, false)
+	if len(image.Blocks) != 1 || image.Blocks[0].Address != 0x4000 {
+		t.Fatalf("blocks = %v", image.Blocks)
+	}
+	want := []uint16{
+		vm.FLAG_IR | vm.CMD_MOV, 0x5000, vm.REGISTER_AX,
+		vm.FLAG_RR | vm.CMD_MOV, 0x3000, vm.REGISTER_BX,
+		vm.FLAG_RR | vm.CMD_MOV, 0x0202, vm.REGISTER_CX,
+		vm.FLAG_IR | vm.CMD_MOV, 0x4000, vm.REGISTER_DX,
+		vm.CMD_HLT,
+	}
+	if got := EncodeWords(want); string(image.Blocks[0].Data) != string(got) {
+		t.Errorf("AssembleLayout = % X, want % X", image.Blocks[0].Data, got)
+	}
+	if got := AssembleImage("MOV IRK CX\nHLT", vm.CODE_BASE, false); got.Blocks[0].Data[3] != byte(vm.IR_KEYBOARD) {
+		t.Errorf("default IRK = % X", got.Blocks[0].Data)
+	}
+}
@@ -0,0 +1,14 @@
+; bitmap test
+MOV OMD BX
+MOV 2 [BX]
+MOV OCH BX
+MOV 0 AX
+loop:
+	MOV AX [BX]
+	ADD AX 0x1111
+	INC BX
+	INC BX
+	MOV BX CX
+	CMP CX 0x1780
+	JIF loop
+	HLT
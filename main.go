@@ -4,6 +4,10 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/lnsp/go-vm/asm"
 	"github.com/lnsp/go-vm/vm"
@@ -13,6 +17,12 @@ import (
 
 var (
 	AssembleFlag = flag.Bool("asm", true, "Assemble source")
+	BanksFlag    = flag.Uint("banks", 0, "Attach a bank controller with 8 or 16 KiB banks")
+	BreakFlag    = flag.Bool("break", false, "Halt and dump machine state on BRK")
+	CompactFlag  = flag.Bool("compact", false, "Assemble using or load the compact encoding")
+	ExportFlag   = flag.String("export", "", "Write the program to a raw, Intel HEX (.hex) or S-record (.srec) file instead of running it")
+	NVRAMFlag    = flag.String("nvram", "", "Persist the NVRAM region to a file")
+	GraceFlag    = flag.Duration("grace", 2*time.Second, "Grace period before forced halt on power-off")
 	pkg          = pkginfo.PackageInfo{
 		Name: "govm",
 		Version: pkginfo.PackageVersion{
@@ -36,18 +46,81 @@ func main() {
 		return
 	}
 
-	bytecode, err := ioutil.ReadFile(args[0])
+	source, err := ioutil.ReadFile(args[0])
 	if err != nil {
-		fmt.Errorf("%v\n", err)
-		return
+		fmt.Println(err)
+		os.Exit(1)
 	}
+	machine := vm.New()
+	layout := machine.Layout()
+	var image vm.Image
 	if *AssembleFlag {
-		bytecode = asm.Assemble(string(bytecode))
+		image = asm.AssembleLayout(string(source), layout, *CompactFlag)
+	} else {
+		decode := vm.DecodeImage
+		if *BanksFlag != 0 {
+			decode = vm.DecodeBankedImage
+		}
+		image, err = decode(source, vm.FormatOf(args[0]), layout.CodeBase)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		image.Compact = image.Compact || *CompactFlag
+	}
+	if *ExportFlag != "" {
+		data, err := vm.EncodeImage(image, vm.FormatOf(*ExportFlag))
+		if err == nil {
+			err = ioutil.WriteFile(*ExportFlag, data, 0644)
+		}
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
 	}
 
-	machine := vm.New()
-	err = machine.Boot(bytecode)
+	switch *BanksFlag {
+	case 0:
+	case 8:
+		machine.AttachBanks(vm.NewBankController(nil, vm.BANK_SIZE_8K, vm.BANK_WINDOW))
+	case 16:
+		machine.AttachBanks(vm.NewBankController(nil, vm.BANK_SIZE_16K, vm.BANK_WINDOW))
+	default:
+		fmt.Println("invalid bank size", *BanksFlag)
+		os.Exit(1)
+	}
+	if *NVRAMFlag != "" {
+		err = machine.AttachNVRAM(vm.NewNVRAM(*NVRAMFlag, int(vm.NVRAM_SIZE)), vm.NVRAM_BASE)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+	var state string
+	if *BreakFlag {
+		machine.SetBreakHandler(func(m *vm.Machine) bool {
+			state = m.String()
+			return false
+		})
+	}
+
+	// Deliver host signals as power-off interrupt
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		for range signals {
+			machine.PowerOff(*GraceFlag)
+		}
+	}()
+
+	err = machine.BootImage(image)
+	signal.Stop(signals)
+	if state != "" {
+		fmt.Println(state)
+	}
 	if err != nil {
 		fmt.Println(err)
+		os.Exit(1)
 	}
 }
@@ -0,0 +1,174 @@
+package vm
+
+import (
+	"fmt"
+	"sync"
+)
+
+// BankController maps one of many banks of a large ROM or RAM image into a
+// window of the address space. Programs select the bank by writing its number
+// to the bank select register.
+type BankController struct {
+	// ReadOnly rejects writes into the window
+	ReadOnly bool
+
+	mutex  sync.Mutex
+	image  []byte
+	size   uint16
+	window uint16
+	bank   uint16
+}
+
+// NewBankController creates a bank controller for an image split into banks
+// of the given size (e.g. BANK_SIZE_8K), mapped into the window starting at window.
+func NewBankController(image []byte, size, window uint16) *BankController {
+	return &BankController{image: image, size: size, window: window}
+}
+
+// Window returns the first and last address of the bank window.
+func (banks *BankController) Window() (uint16, uint16) {
+	return banks.window, banks.window + banks.size - 1
+}
+
+// Banks returns the number of banks in the image.
+func (banks *BankController) Banks() int {
+	banks.mutex.Lock()
+	defer banks.mutex.Unlock()
+	return (len(banks.image) + int(banks.size) - 1) / int(banks.size)
+}
+
+// Bank returns the selected bank.
+func (banks *BankController) Bank() uint16 {
+	banks.mutex.Lock()
+	defer banks.mutex.Unlock()
+	return banks.bank
+}
+
+// SetBank selects the bank mapped into the window.
+func (banks *BankController) SetBank(bank uint16) {
+	banks.mutex.Lock()
+	defer banks.mutex.Unlock()
+	banks.bank = bank
+}
+
+// Image returns the underlying image.
+func (banks *BankController) Image() []byte {
+	banks.mutex.Lock()
+	defer banks.mutex.Unlock()
+	return banks.image
+}
+
+// locate returns the image index of a window offset in the selected bank.
+func (banks *BankController) locate(offset uint16) (int, bool) {
+	index := int(banks.bank)*int(banks.size) + int(offset)
+	return index, offset < banks.size && index < len(banks.image)
+}
+
+// Load fetches a word from the selected bank.
+func (banks *BankController) Load(offset uint16) (uint16, error) {
+	banks.mutex.Lock()
+	defer banks.mutex.Unlock()
+	first, ok := banks.locate(offset)
+	if !ok {
+		return 0, &OutOfRangeError{offset}
+	}
+	value := uint16(banks.image[first]) << 8
+	if second, ok := banks.locate(offset + 1); ok {
+		value |= uint16(banks.image[second])
+	}
+	return value, nil
+}
+
+// Store puts a word into the selected bank.
+// Both bytes are written under one lock, so switching banks never splits the word.
+func (banks *BankController) Store(offset, value uint16) error {
+	banks.mutex.Lock()
+	defer banks.mutex.Unlock()
+	err := banks.storeByte(offset, byte(value>>8))
+	if err != nil {
+		return err
+	}
+	return banks.storeByte(offset+1, byte(value))
+}
+
+// StoreByte puts a byte into the selected bank.
+func (banks *BankController) StoreByte(offset uint16, value byte) error {
+	banks.mutex.Lock()
+	defer banks.mutex.Unlock()
+	return banks.storeByte(offset, value)
+}
+
+// storeByte puts a byte into the selected bank while holding the lock.
+func (banks *BankController) storeByte(offset uint16, value byte) error {
+	if banks.ReadOnly {
+		return &ReadOnlyError{offset}
+	}
+	index, ok := banks.locate(offset)
+	if !ok {
+		return &OutOfRangeError{offset}
+	}
+	banks.image[index] = value
+	return nil
+}
+
+// program copies data into a bank, growing the image if necessary.
+func (banks *BankController) program(bank, addr uint16, data []byte) error {
+	banks.mutex.Lock()
+	defer banks.mutex.Unlock()
+	if addr < banks.window || int(addr-banks.window)+len(data) > int(banks.size) {
+		return fmt.Errorf("block at 0x%4.4X exceeds bank window", addr)
+	}
+	start := int(bank)*int(banks.size) + int(addr-banks.window)
+	if end := start + len(data); end > len(banks.image) {
+		banks.image = append(banks.image, make([]byte, end-len(banks.image))...)
+	}
+	copy(banks.image[start:], data)
+	return nil
+}
+
+// fork creates a bank controller with a copy of the image.
+func (banks *BankController) fork() *BankController {
+	banks.mutex.Lock()
+	defer banks.mutex.Unlock()
+	return &BankController{
+		ReadOnly: banks.ReadOnly,
+		image:    append([]byte(nil), banks.image...),
+		size:     banks.size,
+		window:   banks.window,
+		bank:     banks.bank,
+	}
+}
+
+// bankSelect is the bank select register of a bank controller.
+type bankSelect struct {
+	banks *BankController
+}
+
+// Load returns the selected bank.
+func (reg bankSelect) Load(offset uint16) (uint16, error) {
+	return reg.banks.Bank(), nil
+}
+
+// Store selects a bank.
+func (reg bankSelect) Store(offset, value uint16) error {
+	reg.banks.SetBank(value)
+	return nil
+}
+
+// StoreByte selects a bank by its low byte.
+func (reg bankSelect) StoreByte(offset uint16, value byte) error {
+	if offset == 1 {
+		reg.banks.SetBank(reg.banks.Bank()&0xFF00 | uint16(value))
+	} else {
+		reg.banks.SetBank(reg.banks.Bank()&0x00FF | uint16(value)<<8)
+	}
+	return nil
+}
+
+// AttachBanks maps the bank window and the bank select register of a bank controller onto the bus.
+func (machine *Machine) AttachBanks(banks *BankController) {
+	first, last := banks.Window()
+	machine.bus.Map(first, last, banks)
+	machine.bus.Map(BANK_SELECT, BANK_SELECT+1, bankSelect{banks})
+	machine.banks = banks
+}
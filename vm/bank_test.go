@@ -0,0 +1,91 @@
+package vm
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestBankController(t *testing.T) {
+	banks := NewBankController(make([]byte, 0x300), 0x100, 0xC000)
+	if banks.Banks() != 3 {
+		t.Errorf("banks = %d, want 3", banks.Banks())
+	}
+	banks.SetBank(1)
+	if err := banks.Store(0x10, 0xABCD); err != nil {
+		t.Fatal(err)
+	}
+	if image := banks.Image(); image[0x110] != 0xAB || image[0x111] != 0xCD {
+		t.Errorf("image at 0x110 = % X", image[0x110:0x112])
+	}
+	banks.SetBank(2)
+	if value, err := banks.Load(0x10); err != nil || value != 0 {
+		t.Errorf("bank 2: Load = %04X, %v", value, err)
+	}
+	banks.SetBank(1)
+	if value, err := banks.Load(0x10); err != nil || value != 0xABCD {
+		t.Errorf("bank 1: Load = %04X, %v", value, err)
+	}
+	var outOfRange *OutOfRangeError
+	if _, err := banks.Load(0x100); !errors.As(err, &outOfRange) {
+		t.Errorf("Load behind the window: %v", err)
+	}
+	banks.SetBank(3)
+	if _, err := banks.Load(0); !errors.As(err, &outOfRange) {
+		t.Errorf("Load behind the image: %v", err)
+	}
+	banks.ReadOnly = true
+	var readOnly *ReadOnlyError
+	if err := banks.Store(0, 1); !errors.As(err, &readOnly) {
+		t.Errorf("Store to read-only banks: %v", err)
+	}
+}
+
+func TestBankSwitching(t *testing.T) {
+	machine := newHeadless()
+	banks := NewBankController(nil, BANK_SIZE_8K, BANK_WINDOW)
+	machine.AttachBanks(banks)
+	// MOV BANK_WINDOW CX; MOV [CX] AX; MOV 1 BANK_SELECT; MOV [CX] BX; HLT
+	code := bytecode(
+		FLAG_IR|CMD_MOV, BANK_WINDOW, REGISTER_CX,
+		FLAG_AR|CMD_MOV, REGISTER_CX, REGISTER_AX,
+		FLAG_IR|CMD_MOV, 1, BANK_SELECT,
+		FLAG_AR|CMD_MOV, REGISTER_CX, REGISTER_BX,
+		CMD_HLT)
+	program := append(bytecode(HEADER_MAGIC, HEADER_BLOCKS), EncodeBlocks([]Block{
+		{BANK_NONE, CODE_BASE, code},
+		{0, BANK_WINDOW, []byte{0x11, 0x11}},
+		{1, BANK_WINDOW, []byte{0x22, 0x22}},
+	})...)
+	if err := machine.Boot(program); err != nil {
+		t.Fatal(err)
+	}
+	ax, _ := machine.Load(REGISTER_AX)
+	bx, _ := machine.Load(REGISTER_BX)
+	if ax != 0x1111 || bx != 0x2222 || banks.Bank() != 1 {
+		t.Errorf("AX = %04X, BX = %04X, bank %d", ax, bx, banks.Bank())
+	}
+	if banks.Banks() != 2 {
+		t.Errorf("image holds %d banks, want 2", banks.Banks())
+	}
+}
+
+func TestBankStoreWhileSwitching(t *testing.T) {
+	banks := NewBankController(make([]byte, 0x200), 0x100, 0xC000)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			banks.SetBank(uint16(i % 2))
+		}
+	}()
+	for i := 0; i < 1000; i++ {
+		banks.Store(0x10, 0xABCD)
+	}
+	<-done
+	for bank := uint16(0); bank < 2; bank++ {
+		banks.SetBank(bank)
+		if value, _ := banks.Load(0x10); value != 0 && value != 0xABCD {
+			t.Errorf("bank %d holds the torn word %04X", bank, value)
+		}
+	}
+}
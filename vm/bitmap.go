@@ -0,0 +1,61 @@
+package vm
+
+import (
+	"image"
+	"image/color"
+)
+
+// pixel returns the palette index of a pixel in the bitmap framebuffer.
+// Each byte holds two pixels, the left one in the high nibble.
+func pixel(data []byte, width, x, y int) uint16 {
+	index := (y*width + x) / 2
+	if index >= len(data) {
+		return 0
+	}
+	value := uint16(data[index])
+	if x%2 == 0 {
+		value >>= 4
+	}
+	return value & 0xF
+}
+
+// Palette converts the palette of the display data into image colors.
+// Display data too short to hold the palette yields the default palette.
+func Palette(data []byte) color.Palette {
+	palette := make(color.Palette, OUT_PALETTE)
+	short := len(data) < int(OUT_COLORS-OUT_CHARS+OUT_PALETTE*WORD_SIZE)
+	for i := range palette {
+		rgb := BaseColors[i]
+		if !short {
+			rgb = paletteColor(data[OUT_COLORS-OUT_CHARS:], uint16(i))
+		}
+		r, g, b := rgb>>8&0xF, rgb>>4&0xF, rgb&0xF
+		palette[i] = color.RGBA{uint8(r * 0x11), uint8(g * 0x11), uint8(b * 0x11), 0xFF}
+	}
+	return palette
+}
+
+// Frame decodes the display data of a screen with the given number of cells as bitmap.
+// The bitmap has one pixel per column and two pixels per row of cells, e.g. 80x48 pixels
+// for the terminal, whose 1920 bytes fit below the palette in the display region.
+func Frame(width, height int, data []byte) *image.Paletted {
+	frame := image.NewPaletted(image.Rect(0, 0, width, 2*height), Palette(data))
+	for y := 0; y < 2*height; y++ {
+		for x := 0; x < width; x++ {
+			frame.SetColorIndex(x, y, uint8(pixel(data, width, x, y)))
+		}
+	}
+	return frame
+}
+
+// Frame returns the current contents of the display memory as bitmap, e.g. for headless displays.
+func (machine *Machine) Frame() *image.Paletted {
+	return Frame(OUT_WIDTH, OUT_HEIGHT, machine.screen())
+}
+
+// screen copies the display region up to and including the mode word.
+func (machine *Machine) screen() []byte {
+	data := machine.Segment(machine.layout.chars(), machine.layout.mode())
+	mode, _ := machine.Memory.Load(machine.layout.mode())
+	return append(data, byte(mode>>8), byte(mode))
+}
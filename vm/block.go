@@ -0,0 +1,68 @@
+package vm
+
+import "errors"
+
+// Block is a chunk of program data placed at a fixed address.
+// Blocks in a bank are placed relative to the bank window.
+type Block struct {
+	Bank    uint16
+	Address uint16
+	Data    []byte
+}
+
+// EncodeBlocks serializes blocks as a sequence of bank, address and length words followed by the data.
+func EncodeBlocks(blocks []Block) []byte {
+	var data []byte
+	for _, block := range blocks {
+		header := make([]byte, 3*WORD_SIZE)
+		ByteOrder.PutUint16(header[0:], block.Bank)
+		ByteOrder.PutUint16(header[2:], block.Address)
+		ByteOrder.PutUint16(header[4:], uint16(len(block.Data)))
+		data = append(data, header...)
+		data = append(data, block.Data...)
+	}
+	return data
+}
+
+// DecodeBlocks parses blocks serialized by EncodeBlocks.
+func DecodeBlocks(data []byte) ([]Block, error) {
+	var blocks []Block
+	for len(data) > 0 {
+		if len(data) < int(3*WORD_SIZE) {
+			return nil, errors.New("truncated block header")
+		}
+		block := Block{
+			Bank:    ByteOrder.Uint16(data[0:]),
+			Address: ByteOrder.Uint16(data[2:]),
+		}
+		size := int(ByteOrder.Uint16(data[4:]))
+		data = data[3*WORD_SIZE:]
+		if len(data) < size {
+			return nil, errors.New("truncated block data")
+		}
+		block.Data = data[:size]
+		data = data[size:]
+		blocks = append(blocks, block)
+	}
+	return blocks, nil
+}
+
+// place copies a block into memory or its bank.
+func (machine *Machine) place(block Block) error {
+	if block.Bank != BANK_NONE {
+		if machine.banks == nil {
+			return errors.New("no bank controller attached")
+		}
+		return machine.banks.program(block.Bank, block.Address, block.Data)
+	}
+	if int(block.Address)+len(block.Data) > int(MAX_MEMORY)+1 {
+		return &OutOfRangeError{block.Address}
+	}
+	for i, b := range block.Data {
+		err := machine.Memory.StoreByte(block.Address+uint16(i), b)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,312 @@
+package vm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// Device is a memory-mapped device.
+// Addresses passed to a device are relative to the start of its region.
+type Device interface {
+	Load(offset uint16) (uint16, error)
+	Store(offset, value uint16) error
+	StoreByte(offset uint16, value byte) error
+}
+
+// ReadOnlyError is thrown if a read-only address is written.
+type ReadOnlyError struct {
+	Address uint16
+}
+
+func (err ReadOnlyError) Error() string {
+	return fmt.Sprintf("0x%4.4X is read-only", err.Address)
+}
+
+// Mapping identifies a region mapped onto a bus.
+type Mapping uint32
+
+// busRegion is an address range mapped to a device.
+type busRegion struct {
+	first, last uint16
+	device      Device
+	mapping     Mapping
+}
+
+// Bus is a memory routing address ranges to devices.
+// Regions mapped later take precedence over earlier ones, accesses outside of
+// any region are out of memory range.
+type Bus struct {
+	mutex   sync.RWMutex
+	regions []busRegion
+	changes uint32
+	mapped  Mapping
+}
+
+// NewBus creates a new bus without any devices.
+func NewBus() *Bus {
+	return &Bus{}
+}
+
+// Map routes the addresses from first to last (inclusive) to a device and returns
+// the mapping to pass to Unmap. It panics if first is larger than last.
+func (bus *Bus) Map(first, last uint16, device Device) Mapping {
+	if first > last {
+		panic(fmt.Sprintf("vm: invalid bus range %4.4X-%4.4X", first, last))
+	}
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	bus.mapped++
+	bus.regions = append(bus.regions, busRegion{first, last, device, bus.mapped})
+	atomic.AddUint32(&bus.changes, 1)
+	return bus.mapped
+}
+
+// fork copies the bus, replacing every device by the result of replace.
+func (bus *Bus) fork(replace func(Device) Device) *Bus {
+	bus.mutex.RLock()
+	defer bus.mutex.RUnlock()
+	regions := make([]busRegion, len(bus.regions))
+	for i, region := range bus.regions {
+		regions[i] = busRegion{region.first, region.last, replace(region.device), region.mapping}
+	}
+	return &Bus{regions: regions, changes: bus.version(), mapped: bus.mapped}
+}
+
+// Unmap removes a region returned by Map from the bus.
+func (bus *Bus) Unmap(mapping Mapping) {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	regions := bus.regions[:0]
+	for _, region := range bus.regions {
+		if region.mapping != mapping {
+			regions = append(regions, region)
+		}
+	}
+	bus.regions = regions
+	atomic.AddUint32(&bus.changes, 1)
+}
+
+// version counts the changes to the mapped devices.
+func (bus *Bus) version() uint32 {
+	return atomic.LoadUint32(&bus.changes)
+}
+
+// owns checks if a mapping alone is responsible for a whole address range.
+func (bus *Bus) owns(first, last uint16, mapping Mapping) bool {
+	region, ok := bus.covering(first, last)
+	return ok && region.mapping == mapping
+}
+
+// route finds the region responsible for an address.
+func (bus *Bus) route(addr uint16) (busRegion, bool) {
+	bus.mutex.RLock()
+	defer bus.mutex.RUnlock()
+	for i := len(bus.regions) - 1; i >= 0; i-- {
+		region := bus.regions[i]
+		if addr >= region.first && addr <= region.last {
+			return region, true
+		}
+	}
+	return busRegion{}, false
+}
+
+// covering finds the region responsible for a whole address range.
+func (bus *Bus) covering(first, last uint16) (busRegion, bool) {
+	bus.mutex.RLock()
+	defer bus.mutex.RUnlock()
+	for i := len(bus.regions) - 1; i >= 0; i-- {
+		region := bus.regions[i]
+		if last < region.first || first > region.last {
+			continue
+		}
+		return region, first >= region.first && last <= region.last
+	}
+	return busRegion{}, false
+}
+
+// absolute converts device errors to bus addresses.
+func (region busRegion) absolute(err error) error {
+	switch err := err.(type) {
+	case *OutOfRangeError:
+		return &OutOfRangeError{err.Address + region.first}
+	case *ReadOnlyError:
+		return &ReadOnlyError{err.Address + region.first}
+	}
+	return err
+}
+
+// InRange checks if the given address is mapped to a device.
+func (bus *Bus) InRange(addr uint16) bool {
+	_, ok := bus.route(addr)
+	return ok
+}
+
+// straddles checks if a word at the address crosses the end of its region into the next device.
+func (region busRegion) straddles(addr uint16) bool {
+	return addr == region.last && addr != MAX_MEMORY
+}
+
+// Load fetches a word from the device mapped at the address.
+// A word crossing the end of a region takes its low byte from the next device.
+func (bus *Bus) Load(addr uint16) (uint16, error) {
+	region, ok := bus.route(addr)
+	if !ok {
+		return 0, &OutOfRangeError{addr}
+	}
+	if region.straddles(addr) {
+		high, err := bus.loadByte(addr)
+		if err != nil {
+			return 0, err
+		}
+		low, err := bus.loadByte(addr + 1)
+		return uint16(high)<<8 | uint16(low), err
+	}
+	value, err := region.device.Load(addr - region.first)
+	return value, region.absolute(err)
+}
+
+// loadByte fetches a single byte from a word lying inside the region of the address.
+func (bus *Bus) loadByte(addr uint16) (byte, error) {
+	region, ok := bus.route(addr)
+	if !ok {
+		return 0, &OutOfRangeError{addr}
+	}
+	offset := addr - region.first
+	if offset == 0 {
+		word, err := region.device.Load(offset)
+		return byte(word >> 8), region.absolute(err)
+	}
+	word, err := region.device.Load(offset - 1)
+	return byte(word), region.absolute(err)
+}
+
+// Store puts a word into the device mapped at the address.
+// A word crossing the end of a region stores its low byte into the next device.
+func (bus *Bus) Store(addr, value uint16) error {
+	region, ok := bus.route(addr)
+	if !ok {
+		return &OutOfRangeError{addr}
+	}
+	if region.straddles(addr) {
+		if err := bus.StoreByte(addr, byte(value>>8)); err != nil {
+			return err
+		}
+		return bus.StoreByte(addr+1, byte(value))
+	}
+	return region.absolute(region.device.Store(addr-region.first, value))
+}
+
+// StoreByte puts a byte into the device mapped at the address.
+func (bus *Bus) StoreByte(addr uint16, value byte) error {
+	region, ok := bus.route(addr)
+	if !ok {
+		return &OutOfRangeError{addr}
+	}
+	return region.absolute(region.device.StoreByte(addr-region.first, value))
+}
+
+// Segment returns a copy of a memory segment.
+// Unreadable addresses are returned as zero.
+func (bus *Bus) Segment(from, to uint16) []byte {
+	if to <= from {
+		return nil
+	}
+	if region, ok := bus.covering(from, to-1); ok {
+		if memory, ok := region.device.(Memory); ok {
+			return append([]byte(nil), memory.Segment(from-region.first, to-region.first)...)
+		}
+	}
+	// aligned words never cross the boundary between two devices
+	data := make([]byte, int(to)-int(from))
+	for i := range data {
+		addr := from + uint16(i)
+		word, err := bus.Load(addr &^ 1)
+		if err != nil {
+			continue
+		}
+		if addr%WORD_SIZE == 0 {
+			word >>= 8
+		}
+		data[i] = byte(word)
+	}
+	return data
+}
+
+// Convert converts a word into a slice of bytes.
+func (*Bus) Convert(value uint16) []byte {
+	data := make([]byte, 2)
+	binary.BigEndian.PutUint16(data, value)
+	return data
+}
+
+// readOnlyMemory is a byte storage rejecting all writes.
+type readOnlyMemory []byte
+
+// NewROM creates a read-only device holding the given data.
+func NewROM(data []byte) Device {
+	memory := readOnlyMemory(append([]byte(nil), data...))
+	return &memory
+}
+
+// Load fetches a word from the device.
+func (memory readOnlyMemory) Load(offset uint16) (uint16, error) {
+	if int(offset)+1 >= len(memory) {
+		if int(offset) < len(memory) {
+			return uint16(memory[offset]) << 8, nil
+		}
+		return 0, &OutOfRangeError{offset}
+	}
+	return binary.BigEndian.Uint16(memory[offset : offset+2]), nil
+}
+
+// Store rejects the write.
+func (readOnlyMemory) Store(offset, value uint16) error {
+	return &ReadOnlyError{offset}
+}
+
+// StoreByte rejects the write.
+func (readOnlyMemory) StoreByte(offset uint16, value byte) error {
+	return &ReadOnlyError{offset}
+}
+
+// FuncDevice is a device backed by callbacks, e.g. for memory-mapped I/O registers.
+// Byte writes are turned into word writes of the surrounding word.
+// The callbacks run while the machine holds the lock of its SyncMemory, so accessing
+// the memory of the machine from a callback, e.g. with Machine.Load, deadlocks.
+type FuncDevice struct {
+	OnLoad  func(offset uint16) (uint16, error)
+	OnStore func(offset, value uint16) error
+}
+
+// Load calls the load callback.
+func (device FuncDevice) Load(offset uint16) (uint16, error) {
+	if device.OnLoad == nil {
+		return 0, nil
+	}
+	return device.OnLoad(offset)
+}
+
+// Store calls the store callback.
+func (device FuncDevice) Store(offset, value uint16) error {
+	if device.OnStore == nil {
+		return &ReadOnlyError{offset}
+	}
+	return device.OnStore(offset, value)
+}
+
+// StoreByte reads the surrounding word, replaces the byte and stores the word.
+func (device FuncDevice) StoreByte(offset uint16, value byte) error {
+	aligned := offset &^ 1
+	word, err := device.Load(aligned)
+	if err != nil {
+		return err
+	}
+	if offset == aligned {
+		word = word&0x00FF | uint16(value)<<8
+	} else {
+		word = word&0xFF00 | uint16(value)
+	}
+	return device.Store(aligned, word)
+}
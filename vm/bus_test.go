@@ -0,0 +1,125 @@
+package vm
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestBusRouting(t *testing.T) {
+	bus := NewBus()
+	ram := bus.Map(0, MAX_MEMORY, NewMemory(int(MAX_MEMORY)+1))
+	bus.Map(0x8000, 0x80FF, NewROM([]byte{0x12, 0x34, 0x56}))
+	var stored []uint16
+	bus.Map(0x9000, 0x9003, FuncDevice{
+		OnLoad: func(offset uint16) (uint16, error) {
+			return 0xAB00 | offset, nil
+		},
+		OnStore: func(offset, value uint16) error {
+			stored = append(stored, offset, value)
+			return nil
+		},
+	})
+	if err := bus.Store(0x7FFE, 0x4242); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		addr, want uint16
+	}{
+		{0x7FFE, 0x4242},
+		{0x8000, 0x1234},
+		{0x8002, 0x5600},
+		{0x8100, 0},
+		{0x9002, 0xAB02},
+	} {
+		if got, err := bus.Load(c.addr); err != nil || got != c.want {
+			t.Errorf("Load(%04X) = %04X, %v, want %04X", c.addr, got, err, c.want)
+		}
+	}
+	var readOnly *ReadOnlyError
+	if err := bus.Store(0x8002, 1); !errors.As(err, &readOnly) || readOnly.Address != 0x8002 {
+		t.Errorf("Store to ROM: %v", err)
+	}
+	var outOfRange *OutOfRangeError
+	if _, err := bus.Load(0x8004); !errors.As(err, &outOfRange) || outOfRange.Address != 0x8004 {
+		t.Errorf("Load behind ROM data: %v", err)
+	}
+	bus.StoreByte(0x9001, 0xCD)
+	bus.Store(0x9002, 7)
+	if want := []uint16{0, 0xABCD, 2, 7}; !reflect.DeepEqual(stored, want) {
+		t.Errorf("device stores %04X, want %04X", stored, want)
+	}
+
+	bus.Unmap(ram)
+	if bus.InRange(0x1000) || !bus.InRange(0x8000) {
+		t.Error("unmapped RAM still in range")
+	}
+	rom := bus.Map(0xA000, 0xA001, NewROM([]byte{1, 2}))
+	device := bus.Map(0xA002, 0xA003, FuncDevice{})
+	bus.Unmap(rom)
+	bus.Unmap(device)
+	if bus.InRange(0xA000) || bus.InRange(0xA002) || !bus.InRange(0x9000) {
+		t.Error("unmapping ROM and function device failed")
+	}
+	if _, err := bus.Load(0x1000); !errors.As(err, &outOfRange) || outOfRange.Address != 0x1000 {
+		t.Errorf("Load from unmapped address: %v", err)
+	}
+}
+
+func TestBusInvalidRange(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("reversed range mapped")
+		}
+	}()
+	NewBus().Map(0x0200, 0x01FF, NewMemory(0x100))
+}
+
+func TestBusStraddling(t *testing.T) {
+	bus := NewBus()
+	bus.Map(0, 0x00FF, NewMemory(0x100))
+	bus.Map(0x0100, 0x01FF, NewMemory(0x100))
+	if err := bus.Store(0x00FF, 0x1234); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		addr, want uint16
+	}{
+		{0x00FE, 0x0012},
+		{0x00FF, 0x1234},
+		{0x0100, 0x3400},
+	} {
+		if got, err := bus.Load(c.addr); err != nil || got != c.want {
+			t.Errorf("Load(%04X) = %04X, %v, want %04X", c.addr, got, err, c.want)
+		}
+	}
+	var outOfRange *OutOfRangeError
+	if _, err := bus.Load(0x01FF); !errors.As(err, &outOfRange) || outOfRange.Address != 0x0200 {
+		t.Errorf("Load at end of bus: %v", err)
+	}
+}
+
+func TestMachineROM(t *testing.T) {
+	machine := newHeadless()
+	machine.Bus().Map(0x3000, 0x30FF, NewROM([]byte{0xBE, 0xEF}))
+	// MOV 0x3000 CX; MOV [CX] AX; HLT
+	err := machine.Boot(bytecode(
+		FLAG_IR|CMD_MOV, 0x3000, REGISTER_CX,
+		FLAG_AR|CMD_MOV, REGISTER_CX, REGISTER_AX,
+		CMD_HLT))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ax, _ := machine.Load(REGISTER_AX); ax != 0xBEEF {
+		t.Errorf("AX = %04X, want BEEF", ax)
+	}
+	// MOV 1 [CX] with CX = 0x3000
+	err = machine.Boot(bytecode(
+		FLAG_IR|CMD_MOV, 0x3000, REGISTER_CX,
+		FLAG_IA|CMD_MOV, 1, REGISTER_CX,
+		CMD_HLT))
+	var readOnly *ReadOnlyError
+	if !errors.As(err, &readOnly) || readOnly.Address != 0x3000 {
+		t.Errorf("store to ROM: %v", err)
+	}
+}
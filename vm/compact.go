@@ -0,0 +1,88 @@
+package vm
+
+// The compact encoding (ISA v2) stores the command in the first byte
+// and the flag nibble plus two 2-bit operand forms in the second byte.
+// Register operands share a single packed byte following the command,
+// short and word operands follow in argument order.
+
+// compactForm returns the operand form of the i-th argument.
+func compactForm(mode uint16, i int) uint16 {
+	return (mode >> uint(2-2*i)) & 0x3
+}
+
+// codeBuffer holds the code pointer while the operands of a compact command are decoded.
+// Code is fetched in whole words, the second byte is kept for the next fetch.
+type codeBuffer struct {
+	pointer  uint16
+	low      byte
+	buffered bool
+}
+
+// fetchByte handles the next command byte.
+// Only words at even addresses are buffered, so both bytes share a page and its permissions.
+func (machine *Machine) fetchByte(buffer *codeBuffer) (byte, error) {
+	if buffer.buffered {
+		buffer.pointer++
+		buffer.buffered = false
+		return buffer.low, nil
+	}
+	pointer := buffer.pointer
+	if pointer >= MAX_MEMORY {
+		return 0, &FaultError{Fault: FAULT_CODE_OVERFLOW, Address: pointer}
+	}
+	err := machine.checkExecute(pointer)
+	if err != nil {
+		return 0, err
+	}
+	word, err := machine.paging.fetch(machine.Memory, pointer)
+	if err != nil {
+		return 0, err
+	}
+	buffer.pointer++
+	buffer.low, buffer.buffered = byte(word), pointer%WORD_SIZE == 0
+	return byte(word >> 8), nil
+}
+
+// parseCompactState decodes a compact command and fetches its arguments from memory.
+func (machine *Machine) parseCompactState() error {
+	machine.command = machine.next >> 8
+	machine.flag = (machine.next & 0xF0) << 4
+
+	pointer, err := machine.loadRegister(CODE_POINTER)
+	if err != nil {
+		return err
+	}
+	buffer := codeBuffer{pointer: pointer}
+	var registers byte
+	if compactForm(machine.next, 0) == COMPACT_REGISTER || compactForm(machine.next, 1) == COMPACT_REGISTER {
+		registers, err = machine.fetchByte(&buffer)
+		if err != nil {
+			return err
+		}
+	}
+	for i := 0; i < int(MAX_CMD_ARGS); i++ {
+		switch compactForm(machine.next, i) {
+		case COMPACT_NONE:
+			machine.args[i] = 0
+		case COMPACT_REGISTER:
+			machine.args[i] = uint16(registers>>uint(4-4*i)&0xF) * WORD_SIZE
+		case COMPACT_SHORT:
+			short, err := machine.fetchByte(&buffer)
+			if err != nil {
+				return err
+			}
+			machine.args[i] = uint16(int8(short))
+		case COMPACT_WORD:
+			high, err := machine.fetchByte(&buffer)
+			if err != nil {
+				return err
+			}
+			low, err := machine.fetchByte(&buffer)
+			if err != nil {
+				return err
+			}
+			machine.args[i] = uint16(high)<<8 | uint16(low)
+		}
+	}
+	return machine.storeRegister(CODE_POINTER, buffer.pointer)
+}
@@ -0,0 +1,57 @@
+package vm
+
+import "testing"
+
+// pack converts bytes into words, padding an odd byte with zero.
+func pack(data []byte) []uint16 {
+	words := make([]uint16, (len(data)+1)/2)
+	for i, b := range data {
+		words[i/2] |= uint16(b) << uint(8-8*(i%2))
+	}
+	return words
+}
+
+// decodeAt fetches and decodes the command placed at the code base.
+func decodeAt(t *testing.T, words []uint16, compact bool) *Machine {
+	machine := newHeadless()
+	load(t, machine, words...)
+	machine.compact = compact
+	if err := machine.iterate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := machine.parseState(); err != nil {
+		t.Fatal(err)
+	}
+	return machine
+}
+
+func TestCompactDecoding(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		words   []uint16
+		compact []byte
+	}{
+		{"ADD AX BX", []uint16{FLAG_RR | CMD_ADD, REGISTER_AX, REGISTER_BX}, []byte{0x01, 0x15, 0x45}},
+		{"ADD AX 4", []uint16{FLAG_RI | CMD_ADD, REGISTER_AX, 4}, []byte{0x01, 0x25, 0x42}},
+		{"ADD AX -2", []uint16{FLAG_RI | CMD_ADD, REGISTER_AX, 0xFFFE}, []byte{0x01, 0x26, 0x40, 0xFE}},
+		{"SUB CX 0x1F", []uint16{FLAG_RI | CMD_SUB, REGISTER_CX, 0x1F}, []byte{0x02, 0x26, 0x60, 0x1F}},
+		{"MOV 0x1234 [0x3000]", []uint16{FLAG_IA | CMD_MOV, 0x1234, 0x3000}, []byte{0x0D, byte(FLAG_IA>>4) | 0xF, 0x12, 0x34, 0x30, 0x00}},
+		{"JMP 0x4000", []uint16{FLAG_I | CMD_JMP, 0x4000}, []byte{0x13, 0x8C, 0x40, 0x00}},
+		{"JMP -6", []uint16{FLAG_P | CMD_JMP, 0xFFFA}, []byte{0x13, 0xD8, 0xFA}},
+		{"HLT", []uint16{CMD_HLT}, []byte{0x16, 0x00}},
+	} {
+		standard := decodeAt(t, c.words, false)
+		compact := decodeAt(t, pack(c.compact), true)
+		if compact.command != standard.command || compact.flag != standard.flag {
+			t.Errorf("%s: compact command %02X flag %04X, want %02X %04X", c.name, compact.command, compact.flag, standard.command, standard.flag)
+		}
+		for i := 0; i < FlagSize[standard.flag]; i++ {
+			if compact.args[i] != standard.args[i] {
+				t.Errorf("%s: compact argument %d = %04X, want %04X", c.name, i, compact.args[i], standard.args[i])
+			}
+		}
+		if pointer, _ := compact.Load(CODE_POINTER); pointer != CODE_BASE+uint16(len(c.compact)) {
+			t.Errorf("%s: code pointer %04X after %d bytes", c.name, pointer, len(c.compact))
+		}
+	}
+}
@@ -16,14 +16,45 @@ const (
 	IR_STATE      uint16 = 0x0012
 	IR_KEYBOARD   uint16 = 0x0014
 	IR_OVERFLOW   uint16 = 0x0016
+	IR_TIMER      uint16 = 0x0018
+	IR_DOUBLE     uint16 = 0x001A
+	IR_PROTECTION uint16 = 0x001C
+	IR_PAGE       uint16 = 0x001E
+	IR_BASE       uint16 = 0x0032
+	IR_MASK       uint16 = 0x0034
+	IR_FAULT      uint16 = 0x0036
+	KEY_DATA      uint16 = 0x0040
+	KEY_MODIFIERS uint16 = 0x0042
+	TIMER_CONTROL uint16 = 0x0044
+	TIMER_PERIOD  uint16 = 0x0046
+	TIMER_TICKS   uint16 = 0x0048
+	BANK_SELECT   uint16 = 0x004A
+	NVRAM_CONTROL uint16 = 0x004C
+	SYSTEM_INFO   uint16 = 0x0050
 	STACK_BASE    uint16 = 0x0100
 	STACK_MAX     uint16 = 0x01FF
+	STACK_RESERVE uint16 = 0x0010
 	OUT_CHARS     uint16 = 0x1000
 	OUT_COLORS    uint16 = 0x1F00
 	OUT_MODE      uint16 = 0x1FFE
 	OUT_MODE_TERM uint16 = 0x0001
+	OUT_MODE_BMP  uint16 = 0x0002
+	OUT_MODE_ATTR uint16 = 0x0100 // with OUT_MODE_TERM, cells trade colors and characters for styles
+	OUT_WIDTH            = 80     // cells
+	OUT_HEIGHT           = 24     // cells
+	OUT_PALETTE   uint16 = 0x0010 // palette entries
+	DISPLAY_SIZE  uint16 = 0x1000
 	CODE_BASE     uint16 = 0x2000
 
+	OUT_ATTR_BOLD      uint16 = 0x80 // in the attribute byte of a cell, with OUT_MODE_ATTR
+	OUT_ATTR_BLINK     uint16 = 0x08 // in the attribute byte of a cell, with OUT_MODE_ATTR
+	OUT_CHAR_UNDERLINE uint16 = 0x80 // in the character byte of a cell, with OUT_MODE_ATTR
+
+	REGISTER_FILE_END uint16 = 0x0018 // registers below are held in native fields
+	CONTROL_FILE_END  uint16 = 0x004A // control registers from IR_BASE below are held in native fields
+
+	OUT_FRAME_RATE = 30 // frames per second
+
 	FLAG_MASK uint16 = 0xFF00
 	FLAG_RR   uint16 = 0x0100
 	FLAG_RI   uint16 = 0x0200
@@ -37,34 +68,102 @@ const (
 	FLAG_I    uint16 = 0x0800
 	FLAG_R    uint16 = 0x0900
 	FLAG_A    uint16 = 0x0A00
+	FLAG_P    uint16 = 0x0D00
 	FLAG_NONE uint16 = 0x0000
 
-	CMD_MASK uint16 = 0x00FF
-	CMD_ADD  uint16 = 0x01 // R,R - R,I
-	CMD_SUB  uint16 = 0x02 // R,R - R,I
-	CMD_MUL  uint16 = 0x03 // R,R - R,I
-	CMD_DIV  uint16 = 0x04 // R,R - R,I
-	CMD_INC  uint16 = 0x05 // R
-	CMD_DEC  uint16 = 0x06 // R
-	CMD_AND  uint16 = 0x07 // R,R - R,I
-	CMD_OR   uint16 = 0x08 // R,R - R,I
-	CMD_XOR  uint16 = 0x09 // R,R - R,I
-	CMD_NOT  uint16 = 0x0A // R,R - R,I
-	CMD_SHL  uint16 = 0x0B // R,R - R,I
-	CMD_SHR  uint16 = 0x0C // R,R - R,I
-	CMD_MOV  uint16 = 0x0D // R,R - R,A - A,A - A,R - I,A - I,R
-	CMD_PUSH uint16 = 0x0E // R - I
-	CMD_POP  uint16 = 0x0F // R
-	CMD_CMP  uint16 = 0x10 // R,R - R,I
-	CMD_CNT  uint16 = 0x11 // R,R - R,I
-	CMD_LGE  uint16 = 0x17
-	CMD_SME  uint16 = 0x18
-	CMD_JIF  uint16 = 0x12 // R - I
-	CMD_JMP  uint16 = 0x13 // R - I
-	CMD_CALL uint16 = 0x14
-	CMD_RET  uint16 = 0x15
-	CMD_HLT  uint16 = 0x16
+	CMD_MASK    uint16 = 0x00FF
+	CMD_ADD     uint16 = 0x01 // R,R - R,I
+	CMD_SUB     uint16 = 0x02 // R,R - R,I
+	CMD_MUL     uint16 = 0x03 // R,R - R,I
+	CMD_DIV     uint16 = 0x04 // R,R - R,I
+	CMD_INC     uint16 = 0x05 // R
+	CMD_DEC     uint16 = 0x06 // R
+	CMD_AND     uint16 = 0x07 // R,R - R,I
+	CMD_OR      uint16 = 0x08 // R,R - R,I
+	CMD_XOR     uint16 = 0x09 // R,R - R,I
+	CMD_NOT     uint16 = 0x0A // R,R - R,I
+	CMD_SHL     uint16 = 0x0B // R,R - R,I
+	CMD_SHR     uint16 = 0x0C // R,R - R,I
+	CMD_MOV     uint16 = 0x0D // R,R - R,A - A,A - A,R - I,A - I,R
+	CMD_PUSH    uint16 = 0x0E // R - I
+	CMD_POP     uint16 = 0x0F // R
+	CMD_CMP     uint16 = 0x10 // R,R - R,I
+	CMD_CNT     uint16 = 0x11 // R,R - R,I
+	CMD_LGE     uint16 = 0x17
+	CMD_SME     uint16 = 0x18
+	CMD_JIF     uint16 = 0x12 // R - I
+	CMD_JMP     uint16 = 0x13 // R - I
+	CMD_CALL    uint16 = 0x14
+	CMD_RET     uint16 = 0x15
+	CMD_HLT     uint16 = 0x16
+	CMD_BRK     uint16 = 0x19
+	CMD_CPUID   uint16 = 0x1A
+	CMD_XCHG    uint16 = 0x1B // R,R - R,A
+	CMD_CMPXCHG uint16 = 0x1C // R,R - R,A
+	CMD_IRET    uint16 = 0x1D
+	CMD_PROT    uint16 = 0x1E // R,R - R,I - I,R - I,I
+	CMD_SPT     uint16 = 0x1F // R - I
+
+	// 2 added CPUID and the optional extensions, 3 added IRET and the interrupt vector table
+	ISA_VERSION uint16 = 0x0003
+
+	HEADER_MAGIC   uint16 = 0x4756 // "GV"
+	HEADER_SIZE    uint16 = 0x0004
+	HEADER_COMPACT uint16 = 0x0001
+	HEADER_BLOCKS  uint16 = 0x0002
+	HEADER_ENTRY   uint16 = 0x0004
+
+	BANK_NONE     uint16 = 0xFFFF
+	BANK_SIZE_8K  uint16 = 0x2000
+	BANK_SIZE_16K uint16 = 0x4000
+	BANK_WINDOW   uint16 = 0xC000
+
+	SYSTEM_INFO_SIZE   uint16 = 0x10
+	SYSINFO_MEMORY     uint16 = 0x0 // last RAM address
+	SYSINFO_CODE_BASE  uint16 = 0x2
+	SYSINFO_STACK_BASE uint16 = 0x4
+	SYSINFO_STACK_MAX  uint16 = 0x6
+	SYSINFO_DISPLAY    uint16 = 0x8
+	SYSINFO_VECTORS    uint16 = 0xA
+	SYSINFO_VERSION    uint16 = 0xC
+	SYSINFO_FEATURES   uint16 = 0xE
+
+	NVRAM_BASE    uint16 = 0xB000
+	NVRAM_SIZE    uint16 = 0x1000
+	NVRAM_FLUSH   uint16 = 0x1 // control command
+	NVRAM_VALID   uint16 = 0x1 // restored from file
+	NVRAM_CORRUPT uint16 = 0x2 // file checksum mismatch
+	NVRAM_ERROR   uint16 = 0x4 // last flush failed
+
+	COMPACT_NONE     uint16 = 0x0
+	COMPACT_REGISTER uint16 = 0x1 // packed 4-bit word index
+	COMPACT_SHORT    uint16 = 0x2 // sign-extended byte
+	COMPACT_WORD     uint16 = 0x3 // full word
+
+	IR_QUEUE_SIZE   uint16 = 0x10
+	IR_VECTORS      uint16 = 0x10
+	PAGE_SIZE       uint16 = 0x100
+	PAGE_COUNT             = 0x100
+	PTE_PRESENT     uint16 = 0x0001
+	PTE_WRITABLE    uint16 = 0x0002
+	PTE_FRAME       uint16 = 0xFF00
+	KEYBOARD_BUFFER uint16 = 0x10
+	KEY_MOD_ALT     uint16 = 0x1
+	KEY_MOD_SPECIAL uint16 = 0x2 // key is a special key code instead of a character
+	TIMER_ENABLE    uint16 = 0x1
+	TIMER_WALLCLOCK uint16 = 0x2 // period in milliseconds instead of cycles
+
+	VECTOR_STATE      uint16 = 0x0
+	VECTOR_KEYBOARD   uint16 = 0x1
+	VECTOR_OVERFLOW   uint16 = 0x2
+	VECTOR_TIMER      uint16 = 0x3
+	VECTOR_DOUBLE     uint16 = 0x4
+	VECTOR_PROTECTION uint16 = 0x5
+	VECTOR_PAGE       uint16 = 0x6
 
-	IR_OVERFLOW_CODE  uint16 = 0x1
-	IR_OVERFLOW_STACK uint16 = 0x2
+	IR_STATE_POWER_OFF uint16 = 0x1
+	IR_TIMER_EXPIRED   uint16 = 0x1
+	IR_OVERFLOW_CODE   uint16 = 0x1
+	IR_OVERFLOW_STACK  uint16 = 0x2
+	IR_UNDERFLOW_STACK uint16 = 0x3
 )
@@ -0,0 +1,217 @@
+package vm
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+)
+
+// cowPage is a memory page shared by all copy-on-write memories referencing it.
+type cowPage struct {
+	data [PAGE_SIZE]byte
+	refs int32
+}
+
+// COWMemory is a paged memory sharing its pages with forks until either side writes them.
+// Pages that have never been written are not allocated and read as zero.
+// A memory must not be forked while it is written, but forks may be used concurrently.
+type COWMemory struct {
+	pages []*cowPage
+	size  int
+}
+
+// NewCOWMemory creates a new copy-on-write memory with a given range.
+func NewCOWMemory(size int) *COWMemory {
+	count := (size + int(PAGE_SIZE) - 1) / int(PAGE_SIZE)
+	return &COWMemory{pages: make([]*cowPage, count), size: size}
+}
+
+// Fork creates a copy of the memory sharing all pages.
+func (memory *COWMemory) Fork() *COWMemory {
+	pages := make([]*cowPage, len(memory.pages))
+	copy(pages, memory.pages)
+	for _, page := range pages {
+		if page != nil {
+			atomic.AddInt32(&page.refs, 1)
+		}
+	}
+	return &COWMemory{pages: pages, size: memory.size}
+}
+
+// Allocated returns the number of bytes held in pages owned exclusively by this memory.
+func (memory *COWMemory) Allocated() int {
+	allocated := 0
+	for _, page := range memory.pages {
+		if page != nil && atomic.LoadInt32(&page.refs) == 1 {
+			allocated += int(PAGE_SIZE)
+		}
+	}
+	return allocated
+}
+
+// byteAt reads a single byte.
+func (memory *COWMemory) byteAt(addr uint16) byte {
+	page := memory.pages[addr/PAGE_SIZE]
+	if page == nil {
+		return 0
+	}
+	return page.data[addr%PAGE_SIZE]
+}
+
+// writable returns the page holding the address, copying it if it is shared.
+func (memory *COWMemory) writable(addr uint16) *cowPage {
+	index := addr / PAGE_SIZE
+	page := memory.pages[index]
+	switch {
+	case page == nil:
+		page = &cowPage{refs: 1}
+	case atomic.LoadInt32(&page.refs) > 1:
+		shared := page
+		page = &cowPage{data: shared.data, refs: 1}
+		atomic.AddInt32(&shared.refs, -1)
+	default:
+		return page
+	}
+	memory.pages[index] = page
+	return page
+}
+
+// InRange checks if the given address is in memory range.
+func (memory *COWMemory) InRange(addr uint16) bool {
+	return int(addr) < memory.size
+}
+
+// Load fetches a word from memory.
+func (memory *COWMemory) Load(addr uint16) (uint16, error) {
+	if int(addr)+1 >= memory.size {
+		return 0, &OutOfRangeError{addr}
+	}
+	return uint16(memory.byteAt(addr))<<8 | uint16(memory.byteAt(addr+1)), nil
+}
+
+// Store puts a word into memory.
+func (memory *COWMemory) Store(addr, value uint16) error {
+	if int(addr)+1 >= memory.size {
+		return &OutOfRangeError{addr}
+	}
+	memory.writable(addr).data[addr%PAGE_SIZE] = byte(value >> 8)
+	memory.writable(addr + 1).data[(addr+1)%PAGE_SIZE] = byte(value)
+	return nil
+}
+
+// StoreByte puts a byte into memory.
+func (memory *COWMemory) StoreByte(addr uint16, value byte) error {
+	if !memory.InRange(addr) {
+		return &OutOfRangeError{addr}
+	}
+	memory.writable(addr).data[addr%PAGE_SIZE] = value
+	return nil
+}
+
+// Segment returns a copy of a memory segment.
+func (memory *COWMemory) Segment(from, to uint16) []byte {
+	if to <= from {
+		return nil
+	}
+	data := make([]byte, int(to)-int(from))
+	for i := range data {
+		data[i] = memory.byteAt(from + uint16(i))
+	}
+	return data
+}
+
+// Convert converts a word into a slice of bytes.
+func (*COWMemory) Convert(value uint16) []byte {
+	data := make([]byte, 2)
+	binary.BigEndian.PutUint16(data, value)
+	return data
+}
+
+// Fork creates a copy of a stopped machine. Copy-on-write memories mapped on the bus
+// share their pages with the parent until either machine writes them, bank images and an attached
+// NVRAM are copied and all other devices are shared. Only the parent persists the NVRAM to its file.
+// The fork draws to the display of the parent but has its own keyboard with an empty buffer.
+// Memory observers are not inherited. Use Resume to continue its execution.
+func (machine *Machine) Fork() *Machine {
+	var banks *BankController
+	if machine.banks != nil {
+		banks = machine.banks.fork()
+	}
+	var nvram *NVRAM
+	if machine.nvram != nil {
+		nvram = machine.nvram.fork()
+	}
+	// Every field of Machine is copied or replaced here, TestForkFields fails on new fields
+	fork := &Machine{
+		next:       machine.next,
+		flag:       machine.flag,
+		command:    machine.command,
+		args:       machine.args,
+		debug:      machine.debug,
+		display:    machine.display,
+		nvram:      nvram,
+		nvramBase:  machine.nvramBase,
+		restored:   machine.restored,
+		reserved:   machine.reserved,
+		overflowed: machine.overflowed,
+		interrupts: machine.interrupts.clone(),
+		onBreak:    machine.onBreak,
+		compact:    machine.compact,
+		features:   machine.features,
+		keyboard:   NewKeyboard(),
+		banks:      banks,
+		timer:      machine.timer,
+		policies:   machine.policies,
+		current:    machine.current,
+		protection: machine.protection,
+		paging:     machine.paging,
+		frame:      machine.frame.clone(),
+		layout:     machine.layout,
+	}
+	fork.registerMapping, fork.controlMapping = machine.registerMapping, machine.controlMapping
+	fork.keepRunning = 1
+	for addr := CODE_POINTER; addr < CONTROL_FILE_END; addr += WORD_SIZE {
+		fork.registers.set(addr, machine.registers.get(addr))
+	}
+	fork.bus = machine.bus.fork(func(device Device) Device {
+		switch device := device.(type) {
+		case *registerFile:
+			if device == &machine.registers {
+				return &fork.registers
+			}
+		case controlRegisters:
+			if device.file == &machine.registers {
+				return controlRegisters{&fork.registers}
+			}
+		case systemInfo:
+			if device.machine == machine {
+				return systemInfo{fork}
+			}
+		case *frameBuffer:
+			if device == machine.frame {
+				return fork.frame
+			}
+		case *COWMemory:
+			return device.Fork()
+		case *BankController:
+			if device == machine.banks {
+				return banks
+			}
+		case bankSelect:
+			if device.banks == machine.banks {
+				return bankSelect{banks}
+			}
+		case *NVRAM:
+			if device == machine.nvram {
+				return nvram
+			}
+		case nvramControl:
+			if device.nvram == machine.nvram {
+				return nvramControl{nvram}
+			}
+		}
+		return device
+	})
+	fork.Memory = NewSyncMemory(fork.bus)
+	fork.display = rebindDisplay(machine.display, machine.keyboard, fork.keyboard)
+	return fork
+}
@@ -0,0 +1,139 @@
+package vm
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestForkIsolation(t *testing.T) {
+	parent := newHeadless()
+	parent.Memory.Store(0x3000, 0x1111)
+	fork := parent.Fork()
+	fork.Memory.Store(0x3000, 0x2222)
+	fork.Memory.Store(0x3100, 0x3333)
+	parent.Memory.Store(0x3002, 0x4444)
+	for _, c := range []struct {
+		machine *Machine
+		addr    uint16
+		want    uint16
+	}{
+		{parent, 0x3000, 0x1111},
+		{parent, 0x3100, 0},
+		{fork, 0x3000, 0x2222},
+		{fork, 0x3002, 0},
+		{fork, 0x3100, 0x3333},
+	} {
+		if value, _ := c.machine.Memory.Load(c.addr); value != c.want {
+			t.Errorf("Load(%04X) = %04X, want %04X", c.addr, value, c.want)
+		}
+	}
+	parent.Memory.Store(REGISTER_AX, 7)
+	if value, _ := fork.Load(REGISTER_AX); value != 0 {
+		t.Errorf("fork register AX = %d", value)
+	}
+}
+
+func TestForkFields(t *testing.T) {
+	// Fields copied from the parent by Fork
+	copied := []string{"next", "flag", "command", "args", "debug", "onBreak", "compact", "features",
+		"nvramBase", "restored", "timer", "policies", "reserved", "overflowed", "current",
+		"protection", "paging", "layout", "registerMapping", "controlMapping"}
+	// Fields Fork creates for the fork or leaves at their initial state
+	separate := []string{"Memory", "keepRunning", "display", "interrupts", "keyboard", "bus", "banks", "nvram",
+		"mutex", "powerOff", "registers", "frame", "rendering", "rendered", "observed", "executing",
+		"registerVersion", "registersOwned"}
+	kind := reflect.TypeOf(Machine{})
+	var fields []string
+	for i := 0; i < kind.NumField(); i++ {
+		fields = append(fields, kind.Field(i).Name)
+	}
+	handled := append(append([]string(nil), copied...), separate...)
+	sort.Strings(fields)
+	sort.Strings(handled)
+	if !reflect.DeepEqual(fields, handled) {
+		t.Fatalf("Machine fields %v, Fork handles %v", fields, handled)
+	}
+
+	parent := newHeadless(WithStack(0x3000, 0x30FF))
+	parent.SetFeatures(FEATURE_BREAK)
+	parent.SetFaultPolicy(FAULT_PROTECTION, POLICY_ABORT)
+	parent.SetBreakHandler(func(*Machine) bool { return false })
+	parent.Protect(0x4000, 0x40FF, PERM_READ)
+	// MOV 1 AX; BRK
+	if err := parent.Boot(bytecode(FLAG_IR|CMD_MOV, 1, REGISTER_AX, CMD_BRK)); err != nil {
+		t.Fatal(err)
+	}
+	parentValue, forkValue := reflect.ValueOf(parent).Elem(), reflect.ValueOf(parent.Fork()).Elem()
+	for _, name := range copied {
+		want, got := fmt.Sprint(parentValue.FieldByName(name)), fmt.Sprint(forkValue.FieldByName(name))
+		if got != want {
+			t.Errorf("fork %s = %s, want %s", name, got, want)
+		}
+	}
+}
+
+func TestForkKeyboard(t *testing.T) {
+	parent := New()
+	fork := parent.Fork()
+	display, ok := fork.display.(TextDisplay)
+	if !ok || display.Keyboard != fork.Keyboard() || fork.Keyboard() == parent.Keyboard() {
+		t.Error("fork display is not bound to the fork keyboard")
+	}
+}
+
+func TestForkNVRAM(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "save.nv")
+	parent := newHeadless()
+	if err := parent.AttachNVRAM(NewNVRAM(path, int(NVRAM_SIZE)), NVRAM_BASE); err != nil {
+		t.Fatal(err)
+	}
+	// MOV 0x1111 NVRAM_BASE; MOV NVRAM_FLUSH NVRAM_CONTROL; HLT
+	err := parent.Boot(bytecode(
+		FLAG_IR|CMD_MOV, 0x1111, NVRAM_BASE,
+		FLAG_IR|CMD_MOV, NVRAM_FLUSH, NVRAM_CONTROL,
+		CMD_HLT))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fork := parent.Fork()
+	fork.Memory.Store(NVRAM_BASE, 0x2222)
+	if err := fork.flushNVRAM(); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := parent.Memory.Load(NVRAM_BASE); value != 0x1111 {
+		t.Errorf("parent NVRAM = %04X, want 1111", value)
+	}
+	if value, _ := fork.Memory.Load(NVRAM_BASE); value != 0x2222 {
+		t.Errorf("fork NVRAM = %04X, want 2222", value)
+	}
+	if status, _ := fork.Memory.Load(NVRAM_CONTROL); status != parent.nvram.Status() {
+		t.Errorf("fork status = %d, want %d", status, parent.nvram.Status())
+	}
+	file, err := ioutil.ReadFile(path)
+	if err != nil || file[0] != 0x11 || file[1] != 0x11 {
+		t.Errorf("fork flushed into the file of the parent: %v", err)
+	}
+}
+
+func TestCOWMemoryShares(t *testing.T) {
+	memory := NewCOWMemory(int(MAX_MEMORY) + 1)
+	memory.Store(0x1000, 0xABCD)
+	fork := memory.Fork()
+	if memory.Allocated() != 0 || fork.Allocated() != 0 {
+		t.Errorf("shared page counted as allocated: %d, %d", memory.Allocated(), fork.Allocated())
+	}
+	fork.StoreByte(0x1001, 0)
+	if value, _ := memory.Load(0x1000); value != 0xABCD {
+		t.Errorf("parent Load(1000) = %04X", value)
+	}
+	if value, _ := fork.Load(0x1000); value != 0xAB00 {
+		t.Errorf("fork Load(1000) = %04X", value)
+	}
+	if fork.Allocated() != int(PAGE_SIZE) || memory.Allocated() != int(PAGE_SIZE) {
+		t.Errorf("Allocated() = %d, %d", memory.Allocated(), fork.Allocated())
+	}
+}
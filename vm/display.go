@@ -2,7 +2,10 @@
 package vm
 
 import (
-	"time"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 
 	termbox "github.com/nsf/termbox-go"
 )
@@ -15,7 +18,8 @@ type Interrupt struct {
 
 // Display is a drawable display.
 type Display interface {
-	// Draw the data on a display with a specific width and height.
+	// Draw the data on a display with a specific width and height in cells.
+	// The data holds the display region from the character cells up to and including the mode.
 	Draw(width, height int, data []byte)
 	// Init the display driver.
 	Init() error
@@ -24,25 +28,200 @@ type Display interface {
 }
 
 // TermboxDisplay is a generic display based on go-termbox.
-type TermboxDisplay struct{}
+// Key events are forwarded to the keyboard controller, if any.
+type TermboxDisplay struct {
+	Keyboard *Keyboard
+}
 
-func (TermboxDisplay) Init() error {
+func (display TermboxDisplay) Init() error {
 	err := termbox.Init()
 	if err != nil {
 		return err
 	}
-	go func() {
-		for {
-			termbox.PollEvent()
-		}
-	}()
+	termbox.SetOutputMode(outputMode())
+	events.start(display.Keyboard)
 	return nil
 }
 
+// events polls the termbox events. termbox drives a single terminal,
+// so all termbox displays share one poller.
+var events eventPoller
+
+// eventPoller forwards termbox key events from a single goroutine.
+type eventPoller struct {
+	mutex    sync.Mutex
+	keyboard atomic.Value // *Keyboard, loaded by the polling goroutine
+	running  bool
+	stopping int32
+	done     chan struct{}
+}
+
+// start forwards key events to the keyboard, starting the goroutine unless it is running.
+func (poller *eventPoller) start(keyboard *Keyboard) {
+	poller.mutex.Lock()
+	defer poller.mutex.Unlock()
+	poller.keyboard.Store(keyboard)
+	if poller.running {
+		return
+	}
+	poller.running = true
+	atomic.StoreInt32(&poller.stopping, 0)
+	poller.done = make(chan struct{})
+	go poller.poll()
+}
+
+// stop interrupts the goroutine and waits for it to exit.
+func (poller *eventPoller) stop() {
+	poller.mutex.Lock()
+	defer poller.mutex.Unlock()
+	if !poller.running {
+		return
+	}
+	atomic.StoreInt32(&poller.stopping, 1)
+	// blocks until PollEvent has been interrupted
+	termbox.Interrupt()
+	<-poller.done
+	poller.running = false
+}
+
+// poll forwards events until it is interrupted while stopping.
+func (poller *eventPoller) poll() {
+	defer close(poller.done)
+	for {
+		event := termbox.PollEvent()
+		if event.Type == termbox.EventInterrupt && atomic.LoadInt32(&poller.stopping) != 0 {
+			return
+		}
+		if event.Type != termbox.EventKey {
+			continue
+		}
+		// The terminal is in raw mode, so forward Ctrl-C as interrupt signal
+		if event.Key == termbox.KeyCtrlC && event.Ch == 0 {
+			process, err := os.FindProcess(os.Getpid())
+			if err == nil {
+				process.Signal(os.Interrupt)
+			}
+			continue
+		}
+		if keyboard := poller.keyboard.Load().(*Keyboard); keyboard != nil {
+			keyboard.Press(translateKey(event))
+		}
+	}
+}
+
+// translateKey converts a termbox key event into a machine key event.
+func translateKey(event termbox.Event) KeyEvent {
+	var key KeyEvent
+	if event.Ch != 0 {
+		key.Key = uint16(event.Ch)
+	} else {
+		key.Key = uint16(event.Key)
+		key.Modifiers |= KEY_MOD_SPECIAL
+	}
+	if event.Mod&termbox.ModAlt != 0 {
+		key.Modifiers |= KEY_MOD_ALT
+	}
+	return key
+}
+
 func (TermboxDisplay) Close() {
+	events.stop()
 	termbox.Close()
 }
 
+// rebindDisplay returns a termbox display forwarding the key events of a keyboard to another one.
+// Other displays are returned unchanged.
+func rebindDisplay(display Display, from, to *Keyboard) Display {
+	switch display := display.(type) {
+	case TextDisplay:
+		if display.Keyboard == from {
+			display.Keyboard = to
+		}
+		return display
+	case DemoDisplay:
+		if display.Keyboard == from {
+			display.Keyboard = to
+		}
+		return display
+	}
+	return display
+}
+
+// outputMode selects the richest color output supported by the terminal.
+func outputMode() termbox.OutputMode {
+	colorterm := os.Getenv("COLORTERM")
+	switch {
+	case strings.Contains(colorterm, "truecolor"), strings.Contains(colorterm, "24bit"):
+		return termbox.OutputRGB
+	case strings.Contains(os.Getenv("TERM"), "256color"):
+		return termbox.Output256
+	}
+	return termbox.OutputNormal
+}
+
+// paletteColor returns the 12-bit RGB color of a palette entry.
+func paletteColor(palette []byte, index uint16) uint16 {
+	addr := index * WORD_SIZE
+	if index >= OUT_PALETTE || int(addr)+1 >= len(palette) {
+		return 0
+	}
+	return ByteOrder.Uint16(palette[addr:]) & 0xFFF
+}
+
+// colorLevel scales a 4-bit color channel to the six levels of the 256 color cube.
+func colorLevel(channel uint16) uint16 {
+	return (channel*5 + 7) / 15
+}
+
+// colorAttribute converts a 12-bit RGB color into the nearest termbox color of the output mode.
+func colorAttribute(color uint16, mode termbox.OutputMode) termbox.Attribute {
+	r, g, b := color>>8&0xF, color>>4&0xF, color&0xF
+	cube := colorLevel(r)*36 + colorLevel(g)*6 + colorLevel(b)
+	switch mode {
+	case termbox.OutputRGB:
+		return termbox.RGBToAttribute(uint8(r*0x11), uint8(g*0x11), uint8(b*0x11))
+	case termbox.Output256:
+		return termbox.Attribute(0x11 + cube)
+	case termbox.Output216:
+		return termbox.Attribute(1 + cube)
+	case termbox.OutputGrayscale:
+		return termbox.Attribute(1 + (r+g+b)*23/45)
+	}
+	return termbox.ColorBlack + termbox.Attribute(r>>3|g>>3<<1|b>>3<<2)
+}
+
+// textCell decodes a cell of the terminal mode into a character with foreground and background attributes.
+// Cells without color bits use the default colors of the terminal, like plain ASCII before colors were added.
+// Styled cells take the bold and blink bits from the colors and the underline bit from the character.
+func textCell(cell uint16, palette []byte, mode termbox.OutputMode, styled bool) (rune, termbox.Attribute, termbox.Attribute) {
+	attributes, char := cell>>8, cell&0xFF
+	colors := attributes
+	if styled {
+		colors &^= OUT_ATTR_BOLD | OUT_ATTR_BLINK
+	}
+	fg, bg := termbox.ColorDefault, termbox.ColorDefault
+	if colors != 0 {
+		fg = colorAttribute(paletteColor(palette, colors>>4), mode)
+		bg = colorAttribute(paletteColor(palette, colors&0xF), mode)
+	}
+	if styled {
+		if attributes&OUT_ATTR_BOLD != 0 {
+			fg |= termbox.AttrBold
+		}
+		if attributes&OUT_ATTR_BLINK != 0 {
+			fg |= termbox.AttrBlink
+		}
+		if char&OUT_CHAR_UNDERLINE != 0 {
+			fg |= termbox.AttrUnderline
+		}
+		char &^= OUT_CHAR_UNDERLINE
+	}
+	if char == 0 {
+		char = ' '
+	}
+	return rune(char), fg, bg
+}
+
 // DemoDisplay renders a variety of colors.
 type DemoDisplay struct {
 	TermboxDisplay
@@ -58,29 +237,42 @@ func (DemoDisplay) Draw(width, height int, data []byte) {
 	termbox.Flush()
 }
 
-// TextDisplay is a simple termbox console display.
+// TextDisplay is a simple termbox console display for the terminal and bitmap modes.
 type TextDisplay struct {
 	TermboxDisplay
 }
 
-func (TextDisplay) Draw(width, height int, data []byte) {
+// Draw renders the display region in the mode stored at its end.
+func (display TextDisplay) Draw(width, height int, data []byte) {
+	termbox.Clear(termbox.ColorDefault, termbox.ColorDefault)
+	display.Update(width, height, data, nil)
+}
+
+// Update redraws the cells marked as dirty, or all cells if dirty is nil.
+// Colors are resolved through the palette following the character cells.
+func (TextDisplay) Update(width, height int, data []byte, dirty []bool) {
 	var addr, value uint16
-	var char rune
+	output := termbox.SetOutputMode(termbox.OutputCurrent)
+	palette := data[OUT_COLORS-OUT_CHARS:]
+	mode := ByteOrder.Uint16(data[OUT_MODE-OUT_CHARS:])
 
-	termbox.Clear(termbox.ColorDefault, termbox.ColorDefault)
 	for y := 0; y < height; y++ {
 		for x := 0; x < width; x++ {
+			if dirty != nil && !dirty[y*width+x] {
+				continue
+			}
+			if mode == OUT_MODE_BMP {
+				top := colorAttribute(paletteColor(palette, pixel(data, width, x, 2*y)), output)
+				bottom := colorAttribute(paletteColor(palette, pixel(data, width, x, 2*y+1)), output)
+				termbox.SetCell(x, y, '▀', top, bottom)
+				continue
+			}
 			addr = uint16(y*width+x) * WORD_SIZE
 			value = ByteOrder.Uint16(data[addr : addr+WORD_SIZE])
-			if value == 0 {
-				char = ' '
-			} else {
-				char = rune(value)
-			}
-			termbox.SetCell(x, y, char, termbox.ColorDefault, termbox.ColorDefault)
+			char, fg, bg := textCell(value, palette, output, mode&OUT_MODE_ATTR != 0)
+			termbox.SetCell(x, y, char, fg, bg)
 		}
 	}
 
 	termbox.Flush()
-	time.Sleep(50 * time.Millisecond)
 }
@@ -0,0 +1,87 @@
+package vm
+
+import (
+	"testing"
+
+	termbox "github.com/nsf/termbox-go"
+)
+
+// basePalette returns the initial palette as display data.
+func basePalette() []byte {
+	palette := make([]byte, OUT_PALETTE*WORD_SIZE)
+	for i, color := range BaseColors {
+		ByteOrder.PutUint16(palette[i*2:], color)
+	}
+	return palette
+}
+
+func TestTextCell(t *testing.T) {
+	for _, c := range []struct {
+		cell   uint16
+		mode   termbox.OutputMode
+		styled bool
+		char   rune
+		fg, bg termbox.Attribute
+	}{
+		{0x0000, termbox.OutputNormal, false, ' ', termbox.ColorDefault, termbox.ColorDefault},
+		{0x0041, termbox.OutputNormal, false, 'A', termbox.ColorDefault, termbox.ColorDefault},
+		{0x00C4, termbox.OutputNormal, false, 'Ä', termbox.ColorDefault, termbox.ColorDefault},
+		{0x1041, termbox.OutputNormal, false, 'A', termbox.ColorWhite, termbox.ColorBlack},
+		{0x8041, termbox.Output256, false, 'A', 0x11 + 3*36 + 3*6 + 3, 0x11},
+		{0x8041, termbox.OutputNormal, true, 'A', termbox.ColorDefault | termbox.AttrBold, termbox.ColorDefault},
+		{0x21C2, termbox.OutputNormal, true, 'B', termbox.ColorRed | termbox.AttrUnderline, termbox.ColorWhite},
+		{0x9843, termbox.OutputNormal, true, 'C', termbox.ColorWhite | termbox.AttrBold | termbox.AttrBlink, termbox.ColorBlack},
+		{0x5241, termbox.Output256, false, 'A', 0x11 + 5*36 + 5*6, 0x11 + 5*36},
+		{0x0141, termbox.Output256, false, 'A', 0x11, 0x11 + 5*36 + 5*6 + 5},
+	} {
+		char, fg, bg := textCell(c.cell, basePalette(), c.mode, c.styled)
+		if char != c.char || fg != c.fg || bg != c.bg {
+			t.Errorf("textCell(%04X, %t) = %q, %X, %X, want %q, %X, %X", c.cell, c.styled, char, fg, bg, c.char, c.fg, c.bg)
+		}
+	}
+}
+
+func TestColorAttribute(t *testing.T) {
+	if r, g, b := termbox.AttributeToRGB(colorAttribute(0xF80, termbox.OutputRGB)); r != 0xFF || g != 0x88 || b != 0 {
+		t.Errorf("RGB(F80) = %02X%02X%02X", r, g, b)
+	}
+	if black, white := colorAttribute(0x000, termbox.OutputGrayscale), colorAttribute(0xFFF, termbox.OutputGrayscale); black != 1 || white != 24 {
+		t.Errorf("grayscale = %d, %d, want 1, 24", black, white)
+	}
+	if yellow := colorAttribute(0xFF0, termbox.OutputNormal); yellow != termbox.ColorYellow {
+		t.Errorf("normal(FF0) = %d", yellow)
+	}
+}
+
+func TestUpperPaletteEntries(t *testing.T) {
+	palette := basePalette()
+	for i := 8; i < int(OUT_PALETTE); i++ {
+		ByteOrder.PutUint16(palette[i*2:], 0x123)
+	}
+	upper := colorAttribute(0x123, termbox.OutputRGB)
+	for attributes := uint16(0); attributes <= 0xFF; attributes++ {
+		_, fg, bg := textCell(attributes<<8|'A', palette, termbox.OutputRGB, true)
+		if fg&^(termbox.AttrBold|termbox.AttrBlink) == upper || bg == upper {
+			t.Errorf("styled attributes %02X select a palette entry above 7", attributes)
+		}
+	}
+	if _, fg, bg := textCell(0x8F41, palette, termbox.OutputRGB, false); fg != upper || bg != upper {
+		t.Errorf("attributes 8F select %X, %X, want the upper palette entries", fg, bg)
+	}
+	data := make([]byte, OUT_MODE-OUT_CHARS+WORD_SIZE)
+	copy(data[OUT_COLORS-OUT_CHARS:], palette)
+	for i, color := range Palette(data)[8:] {
+		if r, g, b, _ := color.RGBA(); r != 0x1111 || g != 0x2222 || b != 0x3333 {
+			t.Errorf("bitmap entry %d = %04X %04X %04X, want 0123", i+8, r, g, b)
+		}
+	}
+}
+
+func TestBitmapResolution(t *testing.T) {
+	if size := OUT_WIDTH * 2 * OUT_HEIGHT / 2; size > int(OUT_COLORS-OUT_CHARS) {
+		t.Errorf("bitmap of %d bytes overlaps the palette", size)
+	}
+	if bounds := newHeadless().Frame().Bounds(); bounds.Dx() != 80 || bounds.Dy() != 48 {
+		t.Errorf("frame bounds %v, want 80x48", bounds)
+	}
+}
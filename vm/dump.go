@@ -0,0 +1,204 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Bytes shown per dump line
+const dumpLineSize = 0x10
+
+// Region is a named address range used to annotate dumps.
+type Region struct {
+	Name        string
+	First, Last uint16
+}
+
+// Regions describes the default memory layout of the machine.
+var Regions = DefaultLayout.Regions()
+
+// region returns the name of the region holding an address.
+func region(regions []Region, addr uint16) string {
+	for _, region := range regions {
+		if addr >= region.First && addr <= region.Last {
+			return region.Name
+		}
+	}
+	return ""
+}
+
+// Snapshot is a copy of a memory range starting at Base.
+type Snapshot struct {
+	Base uint16
+	Data []byte
+}
+
+// Snapshot copies the memory from first to last (inclusive), ignoring page permissions.
+// The snapshot is empty if first is greater than last.
+func (machine *Machine) Snapshot(first, last uint16) Snapshot {
+	if first > last {
+		return Snapshot{Base: first}
+	}
+	data := machine.Memory.Segment(first, last)
+	word, _ := machine.Memory.Load(last &^ 1)
+	if last%WORD_SIZE == 0 {
+		word >>= 8
+	}
+	return Snapshot{first, append(append([]byte(nil), data...), byte(word))}
+}
+
+// Dump creates an annotated hex dump of the memory from first to last (inclusive).
+func (machine *Machine) Dump(first, last uint16) string {
+	return Dump(machine.Snapshot(first, last), append(machine.layout.Regions(), machine.devices()...))
+}
+
+// Dump creates a hex dump of a snapshot with words, ASCII and UTF-16 columns.
+// Words are aligned to even addresses like in Diff, bytes outside of the snapshot read as zero.
+// Lines are annotated with the names of the regions starting in them.
+func Dump(snapshot Snapshot, regions []Region) string {
+	var dump strings.Builder
+	if len(snapshot.Data) == 0 {
+		return fmt.Sprintf("DUMP %4.4X (empty)", snapshot.Base)
+	}
+	first, end := int(snapshot.Base), int(snapshot.Base)+len(snapshot.Data)
+	fmt.Fprintf(&dump, "DUMP %4.4X - %4.4X\n----------------", first, end-1)
+	for addr := first &^ 1; addr < end; addr += dumpLineSize {
+		size := dumpLineSize
+		if addr+size > end {
+			size = (end - addr + 1) &^ 1
+		}
+
+		var words, ascii, utf16 strings.Builder
+		for i := addr; i < addr+size; i += 2 {
+			word := snapshot.word(i, first, end)
+			fmt.Fprintf(&words, "%4.4X ", word)
+			utf16.WriteRune(printable(rune(word)))
+		}
+		for i := addr; i < addr+size; i++ {
+			if i < first || i >= end {
+				ascii.WriteByte(' ')
+			} else if b := snapshot.Data[i-first]; b < 0x80 {
+				ascii.WriteRune(printable(rune(b)))
+			} else {
+				ascii.WriteByte('.')
+			}
+		}
+		fmt.Fprintf(&dump, "\n%4.4X  %-40s |%-16s| |%-8s|", addr, words.String(), ascii.String(), utf16.String())
+		for _, region := range regions {
+			inside := addr == first&^1 && int(region.First) <= addr && addr <= int(region.Last)
+			starts := int(region.First) >= addr && int(region.First) < addr+size
+			if inside || starts {
+				dump.WriteString(" " + region.Name)
+			}
+		}
+	}
+	return dump.String()
+}
+
+// printable replaces non-printable characters by a dot.
+func printable(r rune) rune {
+	if unicode.IsPrint(r) && r != unicode.ReplacementChar {
+		return r
+	}
+	return '.'
+}
+
+// Columns of a dump line
+const (
+	dumpWordsStart = 6
+	dumpWordsEnd   = dumpWordsStart + 5*dumpLineSize/2
+)
+
+// ParseDump reads a snapshot from a hex dump created by Dump.
+// The range is taken from the header, the words column is read by its position in the line.
+func ParseDump(dump string) (Snapshot, error) {
+	lines := strings.Split(dump, "\n")
+	var first, last uint16
+	if _, err := fmt.Sscanf(lines[0], "DUMP %X (empty)", &first); err == nil {
+		return Snapshot{Base: first}, nil
+	}
+	if _, err := fmt.Sscanf(lines[0], "DUMP %X - %X", &first, &last); err != nil || first > last {
+		return Snapshot{}, errors.New("missing dump header")
+	}
+	start := int(first) &^ 1
+	var data []byte
+	for number, line := range lines[1:] {
+		if len(line) < dumpWordsStart {
+			continue
+		}
+		addr, err := strconv.ParseUint(line[:4], 16, 16)
+		if err != nil {
+			continue
+		}
+		if int(addr) != start+len(data) {
+			return Snapshot{}, fmt.Errorf("line %d: address %4.4X is not contiguous", number+2, addr)
+		}
+		words := line[dumpWordsStart:]
+		if len(words) > dumpWordsEnd-dumpWordsStart {
+			words = words[:dumpWordsEnd-dumpWordsStart]
+		}
+		for _, field := range strings.Fields(words) {
+			value, err := strconv.ParseUint(field, 16, 16)
+			if err != nil || len(field) != 4 {
+				return Snapshot{}, fmt.Errorf("line %d: invalid word %s", number+2, field)
+			}
+			data = append(data, byte(value>>8), byte(value))
+		}
+	}
+	offset, size := int(first)-start, int(last)-int(first)+1
+	if len(data) < offset+size {
+		return Snapshot{}, fmt.Errorf("dump ends before %4.4X", last)
+	}
+	return Snapshot{first, data[offset : offset+size]}, nil
+}
+
+// Change is a word differing between two snapshots.
+type Change struct {
+	Address  uint16
+	Old, New uint16
+}
+
+// Diff lists the words that differ in the overlapping range of two snapshots.
+// Words are aligned to even addresses, bytes of a word outside of the overlapping range read as zero.
+func Diff(old, new Snapshot) []Change {
+	from, to := int(old.Base), int(old.Base)+len(old.Data)
+	if int(new.Base) > from {
+		from = int(new.Base)
+	}
+	if end := int(new.Base) + len(new.Data); end < to {
+		to = end
+	}
+	var changes []Change
+	for addr := from &^ 1; addr < to; addr += 2 {
+		before, after := old.word(addr, from, to), new.word(addr, from, to)
+		if before != after {
+			changes = append(changes, Change{uint16(addr), before, after})
+		}
+	}
+	return changes
+}
+
+// word returns the word at an address, reading bytes outside of the range from first to end as zero.
+func (snapshot Snapshot) word(addr, first, end int) uint16 {
+	var word uint16
+	for i := addr; i < addr+2; i++ {
+		word <<= 8
+		if i >= first && i < end {
+			word |= uint16(snapshot.Data[i-int(snapshot.Base)])
+		}
+	}
+	return word
+}
+
+// DumpDiff formats the changes between two snapshots, annotated with their regions.
+func DumpDiff(changes []Change, regions []Region) string {
+	var dump strings.Builder
+	fmt.Fprintf(&dump, "DIFF %d changed words\n----------------", len(changes))
+	for _, change := range changes {
+		fmt.Fprintf(&dump, "\n%4.4X  %4.4X -> %4.4X  %s", change.Address, change.Old, change.New, region(regions, change.Address))
+	}
+	return dump.String()
+}
@@ -0,0 +1,119 @@
+package vm
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSnapshotReversedRange(t *testing.T) {
+	machine := newHeadless()
+	snapshot := machine.Snapshot(0x3001, 0x3000)
+	if snapshot.Base != 0x3001 || len(snapshot.Data) != 0 {
+		t.Errorf("Snapshot(3001, 3000) = %v", snapshot)
+	}
+	if dump := machine.Dump(0x3001, 0x3000); dump != "DUMP 3001 (empty)" {
+		t.Errorf("Dump(3001, 3000) = %q", dump)
+	}
+}
+
+func TestDumpRoundTrip(t *testing.T) {
+	machine := newHeadless()
+	machine.Memory.Store(0x3000, 0x4142)
+	machine.Memory.Store(0x3010, 0x0043)
+	snapshot := machine.Snapshot(0x2FFF, 0x3011)
+	parsed, err := ParseDump(Dump(snapshot, Regions))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Base != snapshot.Base || string(parsed.Data) != string(snapshot.Data) {
+		t.Errorf("ParseDump = %v, want %v", parsed, snapshot)
+	}
+	changes := Diff(snapshot, machine.Snapshot(0x2FFF, 0x3011))
+	if len(changes) != 0 {
+		t.Errorf("Diff of equal snapshots = %v", changes)
+	}
+}
+
+func TestDiffChangedWords(t *testing.T) {
+	machine := newHeadless()
+	machine.Memory.Store(0x3000, 0x1111)
+	old := machine.Snapshot(0x3000, 0x300F)
+	machine.Memory.Store(0x3004, 0x2222)
+	machine.Memory.StoreByte(0x300B, 0x33)
+	changes := Diff(old, machine.Snapshot(0x3000, 0x300F))
+	want := []Change{{0x3004, 0x0000, 0x2222}, {0x300A, 0x0000, 0x0033}}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("Diff = %v, want %v", changes, want)
+	}
+}
+
+func TestDiffOddBase(t *testing.T) {
+	old := Snapshot{0x2FFF, []byte{0x01, 0x02, 0x03, 0x04, 0x05}}
+	for _, c := range []struct {
+		new  Snapshot
+		want []Change
+	}{
+		// the changed byte at 3000 shares its word with 2FFF, which the new snapshot lacks
+		{Snapshot{0x3000, []byte{0xAA, 0x03, 0x04, 0x05}}, []Change{{0x3000, 0x0203, 0xAA03}}},
+		{Snapshot{0x2FFF, []byte{0x01, 0x02, 0x03, 0x04, 0xBB}}, []Change{{0x3002, 0x0405, 0x04BB}}},
+		{Snapshot{0x3001, []byte{0x03, 0xCC}}, []Change{{0x3002, 0x0400, 0xCC00}}},
+	} {
+		if changes := Diff(old, c.new); !reflect.DeepEqual(changes, c.want) {
+			t.Errorf("Diff(%v) = %v, want %v", c.new, changes, c.want)
+		}
+	}
+}
+
+func TestDumpRegions(t *testing.T) {
+	regions := []Region{{"stack", 0x0100, 0x01FF}, {"display", 0x0200, 0x02FF}}
+	lines := strings.Split(Dump(Snapshot{0x01F0, make([]byte, 0x20)}, regions), "\n")
+	if len(lines) != 4 || !strings.HasSuffix(lines[2], " stack") || !strings.HasSuffix(lines[3], " display") {
+		t.Errorf("Dump lines %q lack the region names", lines)
+	}
+	diff := DumpDiff([]Change{{0x0204, 1, 2}}, regions)
+	if !strings.HasSuffix(diff, "0204  0001 -> 0002  display") {
+		t.Errorf("DumpDiff = %q", diff)
+	}
+}
+
+func TestParseDumpSeparators(t *testing.T) {
+	snapshot := Snapshot{0x3000, []byte("  |a| b|  |c  |\x7c|x")}
+	parsed, err := ParseDump(Dump(snapshot, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Base != snapshot.Base || string(parsed.Data) != string(snapshot.Data) {
+		t.Errorf("ParseDump = %q at %04X, want %q", parsed.Data, parsed.Base, snapshot.Data)
+	}
+}
+
+func TestDumpOddBase(t *testing.T) {
+	dump := Dump(Snapshot{0x2FFF, []byte{0x01, 0x02, 0x03}}, nil)
+	lines := strings.Split(dump, "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[2], "2FFE  0001 0203 ") {
+		t.Errorf("Dump = %q, want words at even addresses", dump)
+	}
+	parsed, err := ParseDump(dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Base != 0x2FFF || string(parsed.Data) != "\x01\x02\x03" {
+		t.Errorf("ParseDump = %v", parsed)
+	}
+}
+
+func TestParseDumpColumns(t *testing.T) {
+	// a region name looking like words must not be read as data
+	snapshot := Snapshot{0x3000, []byte{0x12, 0x34}}
+	parsed, err := ParseDump(Dump(snapshot, []Region{{"ABCD", 0x3000, 0x3001}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Base != snapshot.Base || string(parsed.Data) != string(snapshot.Data) {
+		t.Errorf("ParseDump = %v, want %v", parsed, snapshot)
+	}
+	if _, err := ParseDump("0000  0102"); err == nil {
+		t.Error("ParseDump without header succeeded")
+	}
+}
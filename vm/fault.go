@@ -0,0 +1,187 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Fault is an error condition raised while executing a command.
+type Fault uint16
+
+const (
+	// Stack pointer exceeds the stack
+	FAULT_STACK_OVERFLOW Fault = iota
+	// Pop from an empty stack
+	FAULT_STACK_UNDERFLOW
+	// Code pointer exceeds the memory
+	FAULT_CODE_OVERFLOW
+	// Fault while delivering or handling another fault
+	FAULT_DOUBLE
+	// Access violating the page permissions
+	FAULT_PROTECTION
+	// Access to a missing or read-only virtual page
+	FAULT_PAGE
+
+	faultCount = iota
+)
+
+var (
+	faultNames = [faultCount]string{
+		FAULT_STACK_OVERFLOW:  "stack overflow",
+		FAULT_STACK_UNDERFLOW: "stack underflow",
+		FAULT_CODE_OVERFLOW:   "code overflow",
+		FAULT_DOUBLE:          "double fault",
+		FAULT_PROTECTION:      "protection fault",
+		FAULT_PAGE:            "page fault",
+	}
+	faultVectors = [faultCount]uint16{
+		FAULT_STACK_OVERFLOW:  VECTOR_OVERFLOW,
+		FAULT_STACK_UNDERFLOW: VECTOR_OVERFLOW,
+		FAULT_CODE_OVERFLOW:   VECTOR_OVERFLOW,
+		FAULT_DOUBLE:          VECTOR_DOUBLE,
+		FAULT_PROTECTION:      VECTOR_PROTECTION,
+		FAULT_PAGE:            VECTOR_PAGE,
+	}
+	faultCodes = [faultCount]uint16{
+		FAULT_STACK_OVERFLOW:  IR_OVERFLOW_STACK,
+		FAULT_STACK_UNDERFLOW: IR_UNDERFLOW_STACK,
+		FAULT_CODE_OVERFLOW:   IR_OVERFLOW_CODE,
+	}
+)
+
+func (fault Fault) String() string {
+	if int(fault) < len(faultNames) {
+		return faultNames[fault]
+	}
+	return fmt.Sprintf("fault %d", uint16(fault))
+}
+
+// FaultPolicy decides how the machine reacts to a fault.
+type FaultPolicy int
+
+const (
+	// Deliver the fault to its interrupt handler, abort if there is none
+	POLICY_TRAP FaultPolicy = iota
+	// Abort the program with a FaultError
+	POLICY_ABORT
+	// Like POLICY_TRAP, but raise a double fault if an interrupt is in service
+	POLICY_DOUBLE
+)
+
+// FaultError is returned if a fault aborts the program.
+// Protection and page faults carry the denied access.
+type FaultError struct {
+	Fault   Fault
+	Address uint16
+	Access  Permission
+}
+
+func (err FaultError) Error() string {
+	if err.Access != PERM_NONE {
+		return fmt.Sprintf("%v (%v) at 0x%4.4X", err.Fault, err.Access, err.Address)
+	}
+	return fmt.Sprintf("%v at 0x%4.4X", err.Fault, err.Address)
+}
+
+// code returns the interrupt value of the fault.
+func (err FaultError) code() uint16 {
+	if err.Access != PERM_NONE {
+		return uint16(err.Access)
+	}
+	return faultCodes[err.Fault]
+}
+
+// SetFaultPolicy sets the reaction of the machine to a fault.
+// Double faults are always delivered to their handler if possible.
+func (machine *Machine) SetFaultPolicy(fault Fault, policy FaultPolicy) {
+	if int(fault) < len(machine.policies) {
+		machine.policies[fault] = policy
+	}
+}
+
+// recoverFault handles a fault raised by a command according to the fault policy.
+// It returns the error if the error is not a fault or the fault aborts the program.
+// Code overflows cannot be resumed, a second one before the program continued elsewhere aborts it.
+func (machine *Machine) recoverFault(err error) error {
+	var fault *FaultError
+	if !errors.As(err, &fault) {
+		return err
+	}
+	if fault.Fault == FAULT_CODE_OVERFLOW {
+		if machine.overflowed {
+			return fault
+		}
+		machine.overflowed = true
+	}
+	switch machine.policies[fault.Fault] {
+	case POLICY_ABORT:
+		return fault
+	case POLICY_DOUBLE:
+		if machine.interrupts.InService() != 0 {
+			return machine.doubleFault(fault)
+		}
+	}
+	vector := faultVectors[fault.Fault]
+	handler, err := machine.handler(vector)
+	if err != nil {
+		return err
+	}
+	if handler == 0 {
+		return fault
+	}
+	if machine.interrupts.InService()&(1<<vector) != 0 {
+		return machine.doubleFault(fault)
+	}
+	if fault.Fault == FAULT_PAGE {
+		// Page faults restart the faulting command once the handler returns
+		err = machine.Memory.Store(CODE_POINTER, machine.current)
+		if err != nil {
+			return err
+		}
+	}
+	err = machine.trap(fault.code(), vector, fault.Address)
+	if err != nil {
+		return machine.doubleFault(fault)
+	}
+	return nil
+}
+
+// leaveOverflow forgets a code overflow once its handler returned and execution continues
+// outside of the overflow region, so later overflows are delivered again.
+func (machine *Machine) leaveOverflow() {
+	if !machine.overflowed || machine.interrupts.InService()&(1<<VECTOR_OVERFLOW) != 0 {
+		return
+	}
+	if pointer, err := machine.loadRegister(CODE_POINTER); err == nil && pointer <= MAX_MEMORY-WORD_SIZE {
+		machine.overflowed = false
+	}
+}
+
+// doubleFault delivers a double fault to its handler or aborts the program.
+func (machine *Machine) doubleFault(fault *FaultError) error {
+	double := &FaultError{Fault: FAULT_DOUBLE, Address: fault.Address}
+	handler, err := machine.handler(VECTOR_DOUBLE)
+	if err != nil {
+		return err
+	}
+	if handler == 0 || machine.interrupts.InService()&(1<<VECTOR_DOUBLE) != 0 {
+		return double
+	}
+	err = machine.trap(uint16(fault.Fault), VECTOR_DOUBLE, fault.Address)
+	if err != nil {
+		return double
+	}
+	return nil
+}
+
+// trap stores the fault address and delivers the fault to its handler.
+// Faults may use the reserved part of the stack.
+func (machine *Machine) trap(code, vector, address uint16) error {
+	err := machine.storeRegister(IR_FAULT, address)
+	if err != nil {
+		return err
+	}
+	machine.reserved = true
+	defer func() { machine.reserved = false }()
+	return machine.deliver(code, vector)
+}
@@ -0,0 +1,270 @@
+package vm
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestStackFaults(t *testing.T) {
+	// handler: MOV INTERRUPT BX; MOV IR_FAULT CX; HLT
+	handler := []uint16{
+		FLAG_RR | CMD_MOV, INTERRUPT, REGISTER_BX,
+		FLAG_RR | CMD_MOV, IR_FAULT, REGISTER_CX,
+		CMD_HLT,
+	}
+	// loop: PUSH 1; JMP loop
+	overflow := []uint16{FLAG_I | CMD_PUSH, 1, FLAG_I | CMD_JMP, CODE_BASE + 6}
+	// POP AX; HLT; HLT
+	underflow := []uint16{FLAG_R | CMD_POP, REGISTER_AX, CMD_HLT, CMD_HLT}
+	for _, c := range []struct {
+		name    string
+		body    []uint16
+		handled bool
+		policy  FaultPolicy
+		fault   Fault
+		code    uint16
+		address uint16
+		abort   bool
+	}{
+		{"overflow trap", overflow, true, POLICY_TRAP, FAULT_STACK_OVERFLOW, IR_OVERFLOW_STACK, STACK_MAX - STACK_RESERVE - 1, false},
+		{"overflow abort", overflow, true, POLICY_ABORT, FAULT_STACK_OVERFLOW, IR_OVERFLOW_STACK, STACK_MAX - STACK_RESERVE - 1, true},
+		{"overflow unhandled", overflow, false, POLICY_TRAP, FAULT_STACK_OVERFLOW, IR_OVERFLOW_STACK, STACK_MAX - STACK_RESERVE - 1, true},
+		{"underflow trap", underflow, true, POLICY_TRAP, FAULT_STACK_UNDERFLOW, IR_UNDERFLOW_STACK, STACK_BASE, false},
+		{"underflow abort", underflow, true, POLICY_ABORT, FAULT_STACK_UNDERFLOW, IR_UNDERFLOW_STACK, STACK_BASE, true},
+	} {
+		var vector uint16
+		if c.handled {
+			vector = CODE_BASE + 14
+		}
+		// MOV vector IR_OVERFLOW; body; handler
+		program := append([]uint16{FLAG_IR | CMD_MOV, vector, IR_OVERFLOW}, c.body...)
+		machine := newHeadless()
+		machine.SetFaultPolicy(c.fault, c.policy)
+		err := machine.Boot(bytecode(append(program, handler...)...))
+		if c.abort {
+			var fault *FaultError
+			if !errors.As(err, &fault) || fault.Fault != c.fault || fault.Address != c.address {
+				t.Errorf("%s: error %v, want %v at %04X", c.name, err, c.fault, c.address)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		code, _ := machine.Load(REGISTER_BX)
+		address, _ := machine.Load(REGISTER_CX)
+		if code != c.code || address != c.address {
+			t.Errorf("%s: trapped %04X at %04X, want %04X at %04X", c.name, code, address, c.code, c.address)
+		}
+	}
+}
+
+func TestDeliveryOverflow(t *testing.T) {
+	// MOV handler IR_OVERFLOW; MOV handler IR_TIMER; MOV 01EE SP;
+	// MOV 1 TIMER_PERIOD; MOV TIMER_ENABLE TIMER_CONTROL; loop: JMP loop;
+	// handler: MOV INTERRUPT BX; MOV IR_FAULT CX; HLT
+	program := bytecode(
+		FLAG_IR|CMD_MOV, CODE_BASE+34, IR_OVERFLOW,
+		FLAG_IR|CMD_MOV, CODE_BASE+34, IR_TIMER,
+		FLAG_IR|CMD_MOV, STACK_MAX-STACK_RESERVE-1, STACK_POINTER,
+		FLAG_IR|CMD_MOV, 1, TIMER_PERIOD,
+		FLAG_IR|CMD_MOV, TIMER_ENABLE, TIMER_CONTROL,
+		FLAG_I|CMD_JMP, CODE_BASE+30,
+		FLAG_RR|CMD_MOV, INTERRUPT, REGISTER_BX,
+		FLAG_RR|CMD_MOV, IR_FAULT, REGISTER_CX,
+		CMD_HLT)
+	machine := newHeadless()
+	if err := machine.Boot(program); err != nil {
+		t.Fatal(err)
+	}
+	code, _ := machine.Load(REGISTER_BX)
+	address, _ := machine.Load(REGISTER_CX)
+	if code != IR_OVERFLOW_STACK || address != STACK_MAX-STACK_RESERVE-1 {
+		t.Errorf("trapped %04X at %04X, want %04X at %04X", code, address, IR_OVERFLOW_STACK, STACK_MAX-STACK_RESERVE-1)
+	}
+
+	machine = newHeadless()
+	machine.SetFaultPolicy(FAULT_STACK_OVERFLOW, POLICY_ABORT)
+	err := machine.Boot(program)
+	var fault *FaultError
+	if !errors.As(err, &fault) || fault.Fault != FAULT_STACK_OVERFLOW {
+		t.Errorf("error %v, want stack overflow", err)
+	}
+}
+
+const (
+	testPageHandler   uint16 = 0x2100
+	testDoubleHandler uint16 = 0x2200
+	testPageTable     uint16 = 0x4000
+)
+
+// pagedMachine prepares a machine storing to the missing page 30 with paging enabled.
+// The page fault handler maps page 30 through the table entry at target and returns,
+// a double fault halts the machine if double is set.
+func pagedMachine(t *testing.T, target uint16, double bool) *Machine {
+	machine := newHeadless()
+	load(t, machine,
+		FLAG_IA|CMD_MOV, 0x1234, REGISTER_BX,
+		CMD_HLT)
+	place(t, machine, testPageHandler,
+		FLAG_IA|CMD_MOV, 0x3000|PTE_PRESENT|PTE_WRITABLE, REGISTER_CX,
+		CMD_IRET)
+	place(t, machine, testDoubleHandler, CMD_HLT)
+	place(t, machine, IR_PAGE, testPageHandler)
+	if double {
+		place(t, machine, IR_DOUBLE, testDoubleHandler)
+	}
+	place(t, machine, REGISTER_BX, 0x3000, target)
+	// identity map all pages except 30 and 50
+	for page := uint16(1); page < 0x100; page++ {
+		if page != 0x30 && page != 0x50 {
+			place(t, machine, testPageTable+page*WORD_SIZE, page<<8|PTE_PRESENT|PTE_WRITABLE)
+		}
+	}
+	machine.SetPageTable(testPageTable)
+	return machine
+}
+
+func TestPageFaultRestart(t *testing.T) {
+	machine := pagedMachine(t, testPageTable+0x30*WORD_SIZE, false)
+	if err := machine.run(); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := machine.Memory.Load(0x3000); value != 0x1234 {
+		t.Errorf("restarted store wrote %04X", value)
+	}
+	code, _ := machine.Load(INTERRUPT)
+	address, _ := machine.Load(IR_FAULT)
+	if code != uint16(PERM_WRITE) || address != 0x3000 {
+		t.Errorf("page fault %04X at %04X", code, address)
+	}
+	if machine.interrupts.InService() != 0 {
+		t.Errorf("in service %04X after IRET", machine.interrupts.InService())
+	}
+}
+
+func TestDoubleFault(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		policy FaultPolicy
+		double bool
+		fault  Fault // expected abort
+		abort  bool
+	}{
+		{"delivered", POLICY_TRAP, true, 0, false},
+		{"unhandled", POLICY_TRAP, false, FAULT_DOUBLE, true},
+		{"abort policy", POLICY_ABORT, true, FAULT_PAGE, true},
+	} {
+		// the page fault handler touches the missing page 50
+		machine := pagedMachine(t, 0x5000, c.double)
+		machine.SetFaultPolicy(FAULT_PAGE, c.policy)
+		err := machine.run()
+		if c.abort {
+			var fault *FaultError
+			if !errors.As(err, &fault) || fault.Fault != c.fault {
+				t.Errorf("%s: error %v, want %v", c.name, err, c.fault)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		code, _ := machine.Load(INTERRUPT)
+		address, _ := machine.Load(IR_FAULT)
+		if code != uint16(FAULT_PAGE) || address != 0x5000 {
+			t.Errorf("%s: double fault %04X at %04X", c.name, code, address)
+		}
+		if want := uint16(1<<VECTOR_PAGE | 1<<VECTOR_DOUBLE); machine.interrupts.InService() != want {
+			t.Errorf("%s: in service %04X, want %04X", c.name, machine.interrupts.InService(), want)
+		}
+	}
+}
+
+func TestPagedLastWord(t *testing.T) {
+	machine := newHeadless()
+	place(t, machine, testPageTable+0xFF*WORD_SIZE, 0x3000|PTE_PRESENT|PTE_WRITABLE)
+	place(t, machine, 0x30FE, 0x1122, 0x3344)
+	machine.SetPageTable(testPageTable)
+	if value, err := machine.Load(0xFFFE); err != nil || value != 0x1122 {
+		t.Errorf("Load(FFFE) = %04X, %v", value, err)
+	}
+	var outOfRange *OutOfRangeError
+	if value, err := machine.Load(MAX_MEMORY); !errors.As(err, &outOfRange) || outOfRange.Address != MAX_MEMORY {
+		t.Errorf("Load(FFFF) = %04X, %v", value, err)
+	}
+	if err := machine.Store(MAX_MEMORY, 0); !errors.As(err, &outOfRange) || outOfRange.Address != MAX_MEMORY {
+		t.Errorf("Store(FFFF) = %v", err)
+	}
+	if value, _ := machine.Memory.Load(0x3100); value != 0x3344 {
+		t.Errorf("adjacent physical word changed to %04X", value)
+	}
+}
+
+func TestCodeOverflowResume(t *testing.T) {
+	// MOV handler IR_OVERFLOW; JMP FFFE; handler: INC BX; IRET
+	machine := newHeadless()
+	load(t, machine,
+		FLAG_IR|CMD_MOV, CODE_BASE+10, IR_OVERFLOW,
+		FLAG_I|CMD_JMP, MAX_MEMORY-1,
+		FLAG_R|CMD_INC, REGISTER_BX,
+		CMD_IRET)
+	done := make(chan error)
+	go func() {
+		done <- machine.run()
+	}()
+	select {
+	case err := <-done:
+		var fault *FaultError
+		if !errors.As(err, &fault) || fault.Fault != FAULT_CODE_OVERFLOW || fault.Address != MAX_MEMORY-1 {
+			t.Errorf("error %v, want code overflow at %04X", err, MAX_MEMORY-1)
+		}
+	case <-time.After(5 * time.Second):
+		machine.Halt()
+		t.Fatal("IRET from the code overflow handler did not terminate")
+	}
+	if count, _ := machine.Load(REGISTER_BX); count != 1 {
+		t.Errorf("handler ran %d times, want 1", count)
+	}
+}
+
+func TestCodeOverflowRecovered(t *testing.T) {
+	// MOV handler IR_OVERFLOW; again: JMP FFFE; recover: MOV BX DX; CMP DX 2; JIF again; HLT
+	// handler: INC BX; MOV SP CX; MOV recover [CX]; IRET
+	machine := newHeadless()
+	load(t, machine,
+		FLAG_IR|CMD_MOV, CODE_BASE+28, IR_OVERFLOW,
+		FLAG_I|CMD_JMP, MAX_MEMORY-1,
+		FLAG_RR|CMD_MOV, REGISTER_BX, REGISTER_DX,
+		FLAG_RI|CMD_CMP, REGISTER_DX, 2,
+		FLAG_I|CMD_JIF, CODE_BASE+6,
+		CMD_HLT,
+		FLAG_R|CMD_INC, REGISTER_BX,
+		FLAG_RR|CMD_MOV, STACK_POINTER, REGISTER_CX,
+		FLAG_IA|CMD_MOV, CODE_BASE+10, REGISTER_CX,
+		CMD_IRET)
+	if err := machine.run(); err != nil {
+		t.Fatal(err)
+	}
+	if count, _ := machine.Load(REGISTER_BX); count != 2 {
+		t.Errorf("handler ran %d times, want 2", count)
+	}
+
+	// A halted handler does not keep the machine from trapping overflows after a resume
+	machine = newHeadless()
+	load(t, machine,
+		FLAG_IR|CMD_MOV, CODE_BASE+10, IR_OVERFLOW,
+		FLAG_I|CMD_JMP, MAX_MEMORY-1,
+		FLAG_R|CMD_INC, REGISTER_BX,
+		CMD_HLT)
+	for i := 0; i < 2; i++ {
+		machine.Interrupts().Reset()
+		machine.Store(CODE_POINTER, CODE_BASE)
+		if err := machine.Resume(); err != nil {
+			t.Fatalf("resume %d: %v", i, err)
+		}
+	}
+	if count, _ := machine.Load(REGISTER_BX); count != 2 {
+		t.Errorf("handler ran %d times after resuming, want 2", count)
+	}
+}
@@ -0,0 +1,61 @@
+package vm
+
+// Features is a set of optional instruction set extensions.
+type Features uint16
+
+const (
+	// BRK software breakpoints
+	FEATURE_BREAK Features = 1 << iota
+	// PC-relative jumps and calls
+	FEATURE_RELATIVE
+	// Compact instruction encoding (ISA v2)
+	FEATURE_COMPACT
+	// Atomic exchange instructions
+	FEATURE_ATOMIC
+	// Guest changes to page permissions
+	FEATURE_PROTECTION
+	// Guest switching of page tables
+	FEATURE_PAGING
+	// Bitmap display mode
+	FEATURE_BITMAP
+
+	// No optional extensions
+	FEATURE_NONE Features = 0
+	// All supported extensions
+	FEATURE_ALL = FEATURE_BREAK | FEATURE_RELATIVE | FEATURE_COMPACT | FEATURE_ATOMIC | FEATURE_PROTECTION | FEATURE_PAGING | FEATURE_BITMAP
+)
+
+var (
+	commandFeatures = map[uint16]Features{
+		CMD_BRK:     FEATURE_BREAK,
+		CMD_XCHG:    FEATURE_ATOMIC,
+		CMD_CMPXCHG: FEATURE_ATOMIC,
+		CMD_PROT:    FEATURE_PROTECTION,
+		CMD_SPT:     FEATURE_PAGING,
+	}
+	flagFeatures = map[uint16]Features{
+		FLAG_P: FEATURE_RELATIVE,
+	}
+)
+
+// Has checks if all given features are part of the set.
+func (features Features) Has(feature Features) bool {
+	return features&feature == feature
+}
+
+// Features returns the extensions enabled on the machine.
+func (machine *Machine) Features() Features {
+	return machine.features
+}
+
+// SetFeatures enables exactly the given extensions on the machine.
+func (machine *Machine) SetFeatures(features Features) {
+	machine.features = features & FEATURE_ALL
+	machine.frame.enableBitmap(machine.features.Has(FEATURE_BITMAP))
+}
+
+// supports checks if the current command is enabled on the machine.
+func (machine *Machine) supports() bool {
+	return machine.features.Has(commandFeatures[machine.command]) &&
+		machine.features.Has(flagFeatures[machine.flag])
+}
@@ -0,0 +1,48 @@
+package vm
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIdentify(t *testing.T) {
+	for _, features := range []Features{FEATURE_ALL, FEATURE_NONE, FEATURE_BREAK | FEATURE_COMPACT} {
+		machine := newHeadless()
+		machine.SetFeatures(features)
+		if err := machine.Boot(bytecode(CMD_CPUID, CMD_HLT)); err != nil {
+			t.Fatal(err)
+		}
+		ax, _ := machine.Load(REGISTER_AX)
+		bx, _ := machine.Load(REGISTER_BX)
+		if Features(ax) != features || bx != ISA_VERSION {
+			t.Errorf("CPUID with %04X: AX = %04X, BX = %04X, want %04X, %04X", features, ax, bx, features, ISA_VERSION)
+		}
+	}
+}
+
+func TestDisabledFeatures(t *testing.T) {
+	compact := bytecode(HEADER_MAGIC, HEADER_COMPACT)
+	for _, c := range []struct {
+		name    string
+		feature Features
+		code    []byte
+		err     string
+	}{
+		{"BRK", FEATURE_BREAK, bytecode(CMD_BRK, CMD_HLT), "unsupported command 0019"},
+		{"JMP relative", FEATURE_RELATIVE, bytecode(FLAG_P|CMD_JMP, 0, CMD_HLT), "unsupported command 0D13"},
+		{"compact", FEATURE_COMPACT, append(compact, byte(CMD_HLT), 0), "compact encoding not supported"},
+		{"XCHG", FEATURE_ATOMIC, bytecode(FLAG_RR|CMD_XCHG, REGISTER_AX, REGISTER_BX, CMD_HLT), "unsupported command 011B"},
+		{"PROT", FEATURE_PROTECTION, bytecode(FLAG_II|CMD_PROT, 0x3000, 7, CMD_HLT), "unsupported command 0B1E"},
+		{"SPT", FEATURE_PAGING, bytecode(FLAG_I|CMD_SPT, 0, CMD_HLT), "unsupported command 081F"},
+	} {
+		machine := newHeadless()
+		if err := machine.Boot(c.code); err != nil {
+			t.Errorf("%s enabled: %v", c.name, err)
+		}
+		machine = newHeadless()
+		machine.SetFeatures(FEATURE_ALL &^ c.feature)
+		if err := machine.Boot(c.code); err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s disabled: error %v, want %q", c.name, err, c.err)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package vm
+
+import (
+	"sync"
+	"time"
+)
+
+// DirtyDisplay is a display able to redraw only the cells modified since the last frame.
+type DirtyDisplay interface {
+	Display
+	// Update redraws the cells marked as dirty, one entry per cell.
+	Update(width, height int, data []byte, dirty []bool)
+}
+
+// frameBuffer is the memory of the display region recording the words written since the last frame.
+type frameBuffer struct {
+	mutex   sync.Mutex
+	data    [DISPLAY_SIZE]byte
+	dirty   [DISPLAY_SIZE / WORD_SIZE]bool
+	changed bool
+	bitmap  bool
+}
+
+// clone copies the frame buffer with all words marked as written.
+func (buffer *frameBuffer) clone() *frameBuffer {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+	clone := &frameBuffer{data: buffer.data, changed: true, bitmap: buffer.bitmap}
+	for word := range clone.dirty {
+		clone.dirty[word] = true
+	}
+	return clone
+}
+
+// enableBitmap allows or ignores selecting the bitmap mode.
+// Disabling it switches a display in bitmap mode back to the terminal mode.
+func (buffer *frameBuffer) enableBitmap(enabled bool) {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+	buffer.bitmap = enabled
+	mode := buffer.data[OUT_MODE-OUT_CHARS:]
+	if !enabled && ByteOrder.Uint16(mode) == OUT_MODE_BMP {
+		ByteOrder.PutUint16(mode, OUT_MODE_TERM)
+		buffer.touch(OUT_MODE - OUT_CHARS)
+	}
+}
+
+// write puts bytes into the display region and marks them as written.
+// Writes selecting the bitmap mode are ignored unless it is enabled.
+func (buffer *frameBuffer) write(offset uint16, values ...byte) {
+	mode := buffer.data[OUT_MODE-OUT_CHARS : OUT_MODE-OUT_CHARS+WORD_SIZE]
+	previous := ByteOrder.Uint16(mode)
+	copy(buffer.data[offset:], values)
+	if !buffer.bitmap && ByteOrder.Uint16(mode) == OUT_MODE_BMP {
+		ByteOrder.PutUint16(mode, previous)
+		return
+	}
+	for i := range values {
+		buffer.touch(offset + uint16(i))
+	}
+}
+
+// touch marks the word holding a byte as written.
+func (buffer *frameBuffer) touch(offset uint16) {
+	buffer.dirty[offset/WORD_SIZE] = true
+	buffer.changed = true
+}
+
+// Load fetches a word from the display region.
+// Words crossing the end of the display region are out of range.
+func (buffer *frameBuffer) Load(offset uint16) (uint16, error) {
+	if offset+1 >= DISPLAY_SIZE {
+		return 0, &OutOfRangeError{offset}
+	}
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+	return ByteOrder.Uint16(buffer.data[offset:]), nil
+}
+
+// Store puts a word into the display region.
+func (buffer *frameBuffer) Store(offset, value uint16) error {
+	if offset+1 >= DISPLAY_SIZE {
+		return &OutOfRangeError{offset}
+	}
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+	buffer.write(offset, byte(value>>8), byte(value))
+	return nil
+}
+
+// StoreByte puts a byte into the display region.
+func (buffer *frameBuffer) StoreByte(offset uint16, value byte) error {
+	if offset >= DISPLAY_SIZE {
+		return &OutOfRangeError{offset}
+	}
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+	buffer.write(offset, value)
+	return nil
+}
+
+// frame copies the display data and returns the cells changed since the last frame.
+// Changes to the palette or the mode affect all cells.
+func (buffer *frameBuffer) frame(width, height int) ([]byte, []bool, bool) {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+	data := append([]byte(nil), buffer.data[:]...)
+	dirty := make([]bool, width*height)
+	changed, all := buffer.changed, false
+	mode := ByteOrder.Uint16(data[OUT_MODE-OUT_CHARS:])
+	for word, written := range buffer.dirty {
+		if !written {
+			continue
+		}
+		buffer.dirty[word] = false
+		addr := uint16(word) * WORD_SIZE
+		switch {
+		case addr >= OUT_COLORS-OUT_CHARS && addr < OUT_COLORS-OUT_CHARS+OUT_PALETTE*WORD_SIZE, addr == OUT_MODE-OUT_CHARS:
+			all = true
+		case mode == OUT_MODE_BMP:
+			// a word holds four pixels of the same row
+			for pixel := int(addr) * 2; pixel < int(addr)*2+4; pixel++ {
+				if cell := pixel/width/2*width + pixel%width; cell < len(dirty) {
+					dirty[cell] = true
+				}
+			}
+		case word < len(dirty):
+			dirty[word] = true
+		}
+	}
+	for cell := range dirty {
+		dirty[cell] = dirty[cell] || all
+	}
+	buffer.changed = false
+	return data, dirty, changed
+}
+
+// refresh draws the cells changed since the last frame, or all cells.
+func (machine *Machine) refresh(full bool) {
+	data, dirty, changed := machine.frame.frame(OUT_WIDTH, OUT_HEIGHT)
+	if !changed && !full {
+		return
+	}
+	if display, ok := machine.display.(DirtyDisplay); ok && !full {
+		display.Update(OUT_WIDTH, OUT_HEIGHT, data, dirty)
+		return
+	}
+	machine.display.Draw(OUT_WIDTH, OUT_HEIGHT, data)
+}
+
+// startRendering refreshes the display at a fixed frame rate until stopRendering is called.
+// The first frame is drawn completely.
+func (machine *Machine) startRendering() {
+	stop, done := make(chan struct{}), make(chan struct{})
+	machine.rendering, machine.rendered = stop, done
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(time.Second / OUT_FRAME_RATE)
+		defer ticker.Stop()
+		full := true
+		for {
+			select {
+			case <-stop:
+				machine.refresh(full)
+				return
+			case <-ticker.C:
+				machine.refresh(full)
+				full = false
+			}
+		}
+	}()
+}
+
+// stopRendering draws the last frame and waits for the renderer to finish.
+func (machine *Machine) stopRendering() {
+	if machine.rendering == nil {
+		return
+	}
+	close(machine.rendering)
+	<-machine.rendered
+	machine.rendering, machine.rendered = nil, nil
+}
@@ -0,0 +1,103 @@
+package vm
+
+import "testing"
+
+func TestFrameDirtyCells(t *testing.T) {
+	buffer := &frameBuffer{}
+	if err := buffer.Store(2*WORD_SIZE, 0x1041); err != nil {
+		t.Fatal(err)
+	}
+	data, dirty, changed := buffer.frame(OUT_WIDTH, OUT_HEIGHT)
+	if !changed || !dirty[2] || dirty[1] || dirty[3] || ByteOrder.Uint16(data[4:]) != 0x1041 {
+		t.Errorf("frame after store = %v, cells %v", changed, dirty[:4])
+	}
+	if _, dirty, changed := buffer.frame(OUT_WIDTH, OUT_HEIGHT); changed || dirty[2] {
+		t.Errorf("second frame = %v, cell 2 %v", changed, dirty[2])
+	}
+	if err := buffer.StoreByte(OUT_COLORS-OUT_CHARS, 0x0F); err != nil {
+		t.Fatal(err)
+	}
+	if _, dirty, _ := buffer.frame(OUT_WIDTH, OUT_HEIGHT); !dirty[0] || !dirty[len(dirty)-1] {
+		t.Error("palette change did not mark all cells")
+	}
+}
+
+func TestFrameBitmapCells(t *testing.T) {
+	buffer := &frameBuffer{bitmap: true}
+	buffer.Store(OUT_MODE-OUT_CHARS, OUT_MODE_BMP)
+	buffer.frame(OUT_WIDTH, OUT_HEIGHT)
+	// the second pixel row of the first cell row starts at byte OUT_WIDTH/2
+	buffer.Store(OUT_WIDTH/2, 0xFFFF)
+	_, dirty, _ := buffer.frame(OUT_WIDTH, OUT_HEIGHT)
+	for cell, want := range []bool{true, true, true, true, false} {
+		if dirty[cell] != want {
+			t.Errorf("cell %d dirty = %v, want %v", cell, dirty[cell], want)
+		}
+	}
+	if dirty[OUT_WIDTH] {
+		t.Error("second cell row marked dirty")
+	}
+}
+
+func TestFrameBufferClone(t *testing.T) {
+	buffer := &frameBuffer{}
+	buffer.Store(0, 0x1041)
+	buffer.frame(OUT_WIDTH, OUT_HEIGHT)
+	clone := buffer.clone()
+	data, dirty, changed := clone.frame(OUT_WIDTH, OUT_HEIGHT)
+	if !changed || ByteOrder.Uint16(data) != 0x1041 {
+		t.Errorf("clone frame = %v, %04X", changed, ByteOrder.Uint16(data))
+	}
+	for cell, written := range dirty {
+		if !written {
+			t.Fatalf("clone cell %d not dirty", cell)
+		}
+	}
+	clone.Store(0, 0x1042)
+	if value, _ := buffer.Load(0); value != 0x1041 {
+		t.Errorf("clone store changed the original to %04X", value)
+	}
+}
+
+func TestBitmapFeature(t *testing.T) {
+	machine := newHeadless()
+	mode := machine.layout.mode()
+	if features, _ := machine.Load(SYSTEM_INFO + SYSINFO_FEATURES); !Features(features).Has(FEATURE_BITMAP) {
+		t.Fatalf("features %04X lack the bitmap mode", features)
+	}
+	machine.SetFeatures(FEATURE_ALL &^ FEATURE_BITMAP)
+	machine.Store(mode, OUT_MODE_TERM)
+	for _, store := range []func() error{
+		func() error { return machine.Store(mode, OUT_MODE_BMP) },
+		func() error { return machine.StoreByte(mode+1, byte(OUT_MODE_BMP)) },
+	} {
+		if err := store(); err != nil {
+			t.Fatal(err)
+		}
+		if value, _ := machine.Load(mode); value != OUT_MODE_TERM {
+			t.Errorf("mode = %04X with the bitmap mode disabled", value)
+		}
+	}
+	machine.SetFeatures(FEATURE_ALL)
+	machine.Store(mode, OUT_MODE_BMP)
+	if value, _ := machine.Load(mode); value != OUT_MODE_BMP {
+		t.Errorf("mode = %04X with the bitmap mode enabled", value)
+	}
+	machine.SetFeatures(FEATURE_ALL &^ FEATURE_BITMAP)
+	if value, _ := machine.Load(mode); value != OUT_MODE_TERM {
+		t.Errorf("mode = %04X after disabling the bitmap mode", value)
+	}
+}
+
+func TestPaletteShortData(t *testing.T) {
+	palette := Palette(make([]byte, 16))
+	if len(palette) != int(OUT_PALETTE) {
+		t.Fatalf("%d palette entries", len(palette))
+	}
+	if r, g, b, _ := palette[1].RGBA(); r != 0xFFFF || g != 0xFFFF || b != 0xFFFF {
+		t.Errorf("entry 1 = %04X %04X %04X, want the default white", r, g, b)
+	}
+	if frame := Frame(OUT_WIDTH, OUT_HEIGHT, make([]byte, 16)); frame.ColorIndexAt(OUT_WIDTH-1, 2*OUT_HEIGHT-1) != 0 {
+		t.Error("pixel outside of the data is set")
+	}
+}
@@ -0,0 +1,121 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Intel HEX record types
+const (
+	ihexData           = 0x00
+	ihexEnd            = 0x01
+	ihexSegmentAddress = 0x02
+	ihexSegmentStart   = 0x03
+	ihexLinearAddress  = 0x04
+	ihexLinearStart    = 0x05
+	ihexRecordSize     = 0x10
+)
+
+// decodeIntelHex parses Intel HEX records.
+func decodeIntelHex(data []byte, base uint16, banked bool) (Image, error) {
+	builder := imageBuilder{banked: banked}
+	image := Image{Entry: base}
+	var offset uint32
+	for number, line := range recordLines(data) {
+		record, err := parseIntelHexRecord(line)
+		if err != nil {
+			return Image{}, fmt.Errorf("line %d: %v", number+1, err)
+		}
+		addr, kind, payload := uint32(record[1])<<8|uint32(record[2]), record[3], record[4:len(record)-1]
+		switch kind {
+		case ihexData:
+			if err := builder.add(offset+addr, payload); err != nil {
+				return Image{}, fmt.Errorf("line %d: %v", number+1, err)
+			}
+		case ihexEnd:
+			image.Blocks = builder.blocks
+			return image, nil
+		case ihexSegmentAddress, ihexLinearAddress:
+			if len(payload) != 2 {
+				return Image{}, fmt.Errorf("line %d: invalid address record", number+1)
+			}
+			offset = uint32(payload[0])<<8 | uint32(payload[1])
+			if kind == ihexSegmentAddress {
+				// Segments have no counterpart in the linear bank layout
+				if offset != 0 {
+					return Image{}, fmt.Errorf("line %d: unsupported segment %4.4X", number+1, offset)
+				}
+			} else {
+				offset <<= 16
+			}
+		case ihexSegmentStart, ihexLinearStart:
+			if len(payload) != 4 {
+				return Image{}, fmt.Errorf("line %d: invalid start record", number+1)
+			}
+			if segment := uint16(payload[0])<<8 | uint16(payload[1]); kind == ihexSegmentStart && segment != 0 {
+				return Image{}, fmt.Errorf("line %d: unsupported segment %4.4X", number+1, segment)
+			}
+			image.Entry = uint16(payload[2])<<8 | uint16(payload[3])
+		default:
+			return Image{}, fmt.Errorf("line %d: unknown record type %2.2X", number+1, kind)
+		}
+	}
+	return Image{}, errors.New("missing end of file record")
+}
+
+// parseIntelHexRecord decodes a record and verifies its length and checksum.
+func parseIntelHexRecord(line string) ([]byte, error) {
+	if !strings.HasPrefix(line, ":") {
+		return nil, errors.New("missing record mark")
+	}
+	record, err := parseHex(line[1:])
+	if err != nil {
+		return nil, err
+	}
+	if len(record) < 5 || len(record) != int(record[0])+5 {
+		return nil, errors.New("invalid record length")
+	}
+	var sum byte
+	for _, b := range record {
+		sum += b
+	}
+	if sum != 0 {
+		return nil, errors.New("checksum mismatch")
+	}
+	return record, nil
+}
+
+// writeIntelHexRecord appends a record with its checksum.
+func writeIntelHexRecord(output *strings.Builder, addr uint16, kind byte, payload []byte) {
+	record := append([]byte{byte(len(payload)), byte(addr >> 8), byte(addr), kind}, payload...)
+	var sum byte
+	for _, b := range record {
+		sum += b
+	}
+	record = append(record, -sum)
+	fmt.Fprintf(output, ":%X\n", record)
+}
+
+// encodeIntelHex serializes an image as Intel HEX records using extended linear addresses for banks.
+func encodeIntelHex(image Image) []byte {
+	var output strings.Builder
+	var upper uint16
+	for _, block := range image.Blocks {
+		for start := 0; start < len(block.Data); start += ihexRecordSize {
+			end := start + ihexRecordSize
+			if end > len(block.Data) {
+				end = len(block.Data)
+			}
+			addr := linear(block.Bank, block.Address+uint16(start))
+			if uint16(addr>>16) != upper {
+				upper = uint16(addr >> 16)
+				writeIntelHexRecord(&output, 0, ihexLinearAddress, []byte{byte(upper >> 8), byte(upper)})
+			}
+			writeIntelHexRecord(&output, uint16(addr), ihexData, block.Data[start:end])
+		}
+	}
+	writeIntelHexRecord(&output, 0, ihexLinearStart, []byte{0, 0, byte(image.Entry >> 8), byte(image.Entry)})
+	writeIntelHexRecord(&output, 0, ihexEnd, nil)
+	return []byte(output.String())
+}
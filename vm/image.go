@@ -0,0 +1,231 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Format is a file format of program images.
+type Format int
+
+const (
+	// Raw bytecode, optionally starting with a header
+	FORMAT_RAW Format = iota
+	// Intel HEX records
+	FORMAT_IHEX
+	// Motorola S-records
+	FORMAT_SREC
+)
+
+// FormatOf guesses the format of an image file from its extension.
+func FormatOf(name string) Format {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".hex", ".ihex", ".ihx":
+		return FORMAT_IHEX
+	case ".srec", ".s19", ".s28", ".s37", ".mot":
+		return FORMAT_SREC
+	}
+	return FORMAT_RAW
+}
+
+// Image is a program consisting of blocks placed at their own addresses or banks.
+type Image struct {
+	Blocks []Block
+	// Address of the first command
+	Entry uint16
+	// Commands use the compact encoding
+	Compact bool
+}
+
+// DecodeImage parses a program image in the given format.
+// Raw bytecode without blocks is placed at base, which is also the entry point
+// of images not specifying one. Text images must fit into the 64 KiB address space.
+func DecodeImage(data []byte, format Format, base uint16) (Image, error) {
+	return decodeImage(data, format, base, false)
+}
+
+// DecodeBankedImage parses a program image like DecodeImage, but reads linear addresses
+// of text images beyond 64 KiB as banks (see linear).
+func DecodeBankedImage(data []byte, format Format, base uint16) (Image, error) {
+	return decodeImage(data, format, base, true)
+}
+
+// decodeImage parses a program image, optionally reading high linear addresses as banks.
+func decodeImage(data []byte, format Format, base uint16, banked bool) (Image, error) {
+	switch format {
+	case FORMAT_RAW:
+		return decodeRaw(data, base)
+	case FORMAT_IHEX:
+		return decodeIntelHex(data, base, banked)
+	case FORMAT_SREC:
+		return decodeSRecord(data, base, banked)
+	}
+	return Image{}, errors.New("unknown image format")
+}
+
+// EncodeImage serializes a program image in the given format.
+// Text formats carry no encoding flag, so compact images have to be decoded as such explicitly.
+func EncodeImage(image Image, format Format) ([]byte, error) {
+	switch format {
+	case FORMAT_RAW:
+		return encodeRaw(image), nil
+	case FORMAT_IHEX:
+		return encodeIntelHex(image), nil
+	case FORMAT_SREC:
+		return encodeSRecord(image), nil
+	}
+	return nil, errors.New("unknown image format")
+}
+
+// decodeRaw parses bytecode, which may start with a header selecting the encoding, blocks and the entry point.
+func decodeRaw(data []byte, base uint16) (Image, error) {
+	var flags uint16
+	if len(data) >= int(HEADER_SIZE) && ByteOrder.Uint16(data) == HEADER_MAGIC {
+		flags = ByteOrder.Uint16(data[2:])
+		data = data[HEADER_SIZE:]
+	}
+	image := Image{
+		Blocks:  []Block{{BANK_NONE, base, data}},
+		Entry:   base,
+		Compact: flags&HEADER_COMPACT != 0,
+	}
+	if flags&HEADER_ENTRY != 0 {
+		if len(data) < int(WORD_SIZE) {
+			return Image{}, errors.New("truncated entry point")
+		}
+		image.Entry = ByteOrder.Uint16(data)
+		data = data[WORD_SIZE:]
+		image.Blocks[0].Data = data
+	}
+	if flags&HEADER_BLOCKS != 0 {
+		blocks, err := DecodeBlocks(data)
+		if err != nil {
+			return Image{}, err
+		}
+		image.Blocks = blocks
+		if entry, ok := impliedEntry(blocks); ok && flags&HEADER_ENTRY == 0 {
+			image.Entry = entry
+		}
+	}
+	return image, nil
+}
+
+// impliedEntry returns the entry point of block images without an explicit one,
+// the address of the first block unless it is banked.
+func impliedEntry(blocks []Block) (uint16, bool) {
+	if len(blocks) == 0 || blocks[0].Bank != BANK_NONE {
+		return 0, false
+	}
+	return blocks[0].Address, true
+}
+
+// encodeRaw serializes an image as bytecode, adding a header if required.
+// The entry point of a single block is implied by the load address, block images
+// store it in the header unless it is the address of the first block.
+func encodeRaw(image Image) []byte {
+	var flags uint16
+	if image.Compact {
+		flags |= HEADER_COMPACT
+	}
+	var data []byte
+	if len(image.Blocks) == 1 && image.Blocks[0].Bank == BANK_NONE && image.Blocks[0].Address == image.Entry {
+		data = image.Blocks[0].Data
+	} else if len(image.Blocks) > 0 {
+		flags |= HEADER_BLOCKS
+		data = EncodeBlocks(image.Blocks)
+		if entry, ok := impliedEntry(image.Blocks); !ok || entry != image.Entry {
+			flags |= HEADER_ENTRY
+			data = append([]byte{byte(image.Entry >> 8), byte(image.Entry)}, data...)
+		}
+	}
+	if flags == 0 {
+		return data
+	}
+	header := make([]byte, HEADER_SIZE)
+	ByteOrder.PutUint16(header, HEADER_MAGIC)
+	ByteOrder.PutUint16(header[2:], flags)
+	return append(header, data...)
+}
+
+// linear converts a bank and an address into a linear address of a text image.
+// Unbanked addresses occupy the first 64 KiB, bank n is stored at 64 KiB * (n+1).
+func linear(bank, addr uint16) uint32 {
+	if bank == BANK_NONE {
+		return uint32(addr)
+	}
+	return (uint32(bank)+1)<<16 | uint32(addr)
+}
+
+// bankOf returns the bank holding a linear address of a text image, see linear.
+func bankOf(addr uint32) uint16 {
+	if addr <= uint32(MAX_MEMORY) {
+		return BANK_NONE
+	}
+	return uint16(addr>>16 - 1)
+}
+
+// imageBuilder collects data from text image records into blocks.
+type imageBuilder struct {
+	blocks []Block
+	last   uint32
+	// linear addresses beyond 64 KiB are banks instead of errors
+	banked bool
+}
+
+// add appends data at a linear address, extending the last block if it is contiguous.
+func (builder *imageBuilder) add(addr uint32, data []byte) error {
+	for _, b := range data {
+		if addr > uint32(MAX_MEMORY) && !builder.banked {
+			return fmt.Errorf("address %X beyond 64 KiB without banks", addr)
+		}
+		count := len(builder.blocks)
+		if count == 0 || addr != builder.last || addr&0xFFFF == 0 {
+			builder.blocks = append(builder.blocks, Block{Bank: bankOf(addr), Address: uint16(addr)})
+			count++
+		}
+		builder.blocks[count-1].Data = append(builder.blocks[count-1].Data, b)
+		addr++
+		builder.last = addr
+	}
+	return nil
+}
+
+// parseHex decodes a string of hex digit pairs.
+func parseHex(digits string) ([]byte, error) {
+	if len(digits)%2 != 0 {
+		return nil, errors.New("odd number of hex digits")
+	}
+	data := make([]byte, len(digits)/2)
+	for i := range data {
+		var value byte
+		for _, c := range digits[2*i : 2*i+2] {
+			value <<= 4
+			switch {
+			case c >= '0' && c <= '9':
+				value |= byte(c - '0')
+			case c >= 'A' && c <= 'F':
+				value |= byte(c - 'A' + 10)
+			case c >= 'a' && c <= 'f':
+				value |= byte(c - 'a' + 10)
+			default:
+				return nil, errors.New("invalid hex digit")
+			}
+		}
+		data[i] = value
+	}
+	return data, nil
+}
+
+// recordLines splits a text image into trimmed non-empty lines.
+func recordLines(data []byte) []string {
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
@@ -0,0 +1,114 @@
+package vm
+
+import (
+	"reflect"
+	"testing"
+)
+
+// sequence returns size bytes counting up from first.
+func sequence(first byte, size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = first + byte(i)
+	}
+	return data
+}
+
+func TestImageRoundTrip(t *testing.T) {
+	image := Image{
+		Blocks: []Block{
+			{BANK_NONE, CODE_BASE, sequence(0x00, 0x25)},
+			{BANK_NONE, MAX_MEMORY - 0x13, sequence(0x40, 0x14)},
+			{1, 0x8000, sequence(0x80, 0x11)},
+		},
+		Entry: CODE_BASE + 4,
+	}
+	for _, format := range []Format{FORMAT_RAW, FORMAT_IHEX, FORMAT_SREC} {
+		data, err := EncodeImage(image, format)
+		if err != nil {
+			t.Fatalf("format %d: %v", format, err)
+		}
+		decoded, err := DecodeBankedImage(data, format, CODE_BASE)
+		if err != nil {
+			t.Fatalf("format %d: %v", format, err)
+		}
+		if !reflect.DeepEqual(decoded, image) {
+			t.Errorf("format %d: decoded %+v, want %+v", format, decoded, image)
+		}
+	}
+}
+
+func TestHighLinearAddresses(t *testing.T) {
+	image := Image{Blocks: []Block{{0, 0x8000, sequence(0, 4)}}, Entry: CODE_BASE}
+	for _, format := range []Format{FORMAT_IHEX, FORMAT_SREC} {
+		data, _ := EncodeImage(image, format)
+		if _, err := DecodeImage(data, format, CODE_BASE); err == nil {
+			t.Errorf("format %d: address beyond 64 KiB accepted without banks", format)
+		}
+		decoded, err := DecodeBankedImage(data, format, CODE_BASE)
+		if err != nil || !reflect.DeepEqual(decoded, image) {
+			t.Errorf("format %d: decoded %+v, %v, want %+v", format, decoded, err, image)
+		}
+	}
+	if addr := linear(BANK_NONE, 0x1234); addr != 0x1234 {
+		t.Errorf("linear(BANK_NONE, 1234) = %X", addr)
+	}
+	if bank := bankOf(0x21234); bank != 1 {
+		t.Errorf("bankOf(21234) = %d, want 1", bank)
+	}
+}
+
+func TestImageChecksum(t *testing.T) {
+	image := Image{Blocks: []Block{{BANK_NONE, CODE_BASE, sequence(0, 4)}}, Entry: CODE_BASE}
+	for _, format := range []Format{FORMAT_IHEX, FORMAT_SREC} {
+		data, _ := EncodeImage(image, format)
+		data[len(recordLines(data)[0])-3] ^= 1
+		if _, err := DecodeImage(data, format, CODE_BASE); err == nil {
+			t.Errorf("format %d: corrupt record accepted", format)
+		}
+	}
+}
+
+func TestRawEntry(t *testing.T) {
+	for _, image := range []Image{
+		{Blocks: []Block{{BANK_NONE, 0x4000, sequence(0, 8)}}, Entry: 0x4000},
+		{Blocks: []Block{{BANK_NONE, 0x4000, sequence(0, 8)}}, Entry: 0x4004},
+		{Blocks: []Block{{1, 0x8000, sequence(0, 4)}, {BANK_NONE, 0x4000, sequence(0, 8)}}, Entry: 0x4000},
+	} {
+		data, _ := EncodeImage(image, FORMAT_RAW)
+		decoded, err := DecodeImage(data, FORMAT_RAW, 0x4000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(decoded, image) {
+			t.Errorf("decoded %+v, want %+v", decoded, image)
+		}
+	}
+	// MAGIC, ENTRY and a single byte of the entry point
+	if _, err := DecodeImage(append(bytecode(HEADER_MAGIC, HEADER_ENTRY), 0x20), FORMAT_RAW, CODE_BASE); err == nil {
+		t.Error("truncated entry point accepted")
+	}
+}
+
+func TestIntelHexSegments(t *testing.T) {
+	for _, c := range []struct {
+		records string
+		entry   uint16
+		valid   bool
+	}{
+		{":020000020000FC\n:0400000300002010C9\n:00000001FF\n", 0x2010, true},
+		{":020000021000EC\n:00000001FF\n", 0, false},
+		{":0400000310002010B9\n:00000001FF\n", 0, false},
+	} {
+		image, err := DecodeImage([]byte(c.records), FORMAT_IHEX, CODE_BASE)
+		if !c.valid {
+			if err == nil {
+				t.Errorf("%q: non-zero segment accepted", c.records)
+			}
+			continue
+		}
+		if err != nil || image.Entry != c.entry {
+			t.Errorf("%q: entry %04X, %v, want %04X", c.records, image.Entry, err, c.entry)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package vm
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+type asyncInterrupt struct {
+	Identifier, Vector uint16
+}
+
+// InterruptController is a bounded interrupt queue safe for use from multiple goroutines.
+//
+// Interrupts are raised on one of IR_VECTORS vectors, where lower vectors have
+// a higher priority. The highest priority pending interrupt that is neither
+// masked nor blocked by an interrupt of higher or equal priority in service is
+// delivered first, interrupts on the same vector are delivered in the order
+// they were raised. An interrupt stays in service until its handler returns
+// with IRET.
+//
+// Raising an interrupt equal to one already pending coalesces both into a single
+// delivery. If the queue is full, the new interrupt is dropped and Raise reports
+// false, so raising an interrupt never blocks.
+type InterruptController struct {
+	mutex     sync.Mutex
+	pending   []asyncInterrupt
+	inService uint16
+	// length of pending, read without the mutex by the machine on every step
+	queued int32
+}
+
+// NewInterruptController creates an empty interrupt queue holding up to IR_QUEUE_SIZE interrupts.
+func NewInterruptController() *InterruptController {
+	return &InterruptController{pending: make([]asyncInterrupt, 0, IR_QUEUE_SIZE)}
+}
+
+// Raise queues an interrupt and reports if it is pending.
+func (controller *InterruptController) Raise(code, vector uint16) bool {
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+	if vector >= IR_VECTORS {
+		return false
+	}
+	ir := asyncInterrupt{code, vector}
+	for _, pending := range controller.pending {
+		if pending == ir {
+			return true
+		}
+	}
+	if len(controller.pending) >= int(IR_QUEUE_SIZE) {
+		return false
+	}
+	controller.pending = append(controller.pending, ir)
+	atomic.StoreInt32(&controller.queued, int32(len(controller.pending)))
+	return true
+}
+
+// Pending returns the set of vectors with queued interrupts, one bit per vector.
+func (controller *InterruptController) Pending() uint16 {
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+	var pending uint16
+	for _, ir := range controller.pending {
+		pending |= 1 << ir.Vector
+	}
+	return pending
+}
+
+// InService returns the set of vectors whose handlers are running, one bit per vector.
+func (controller *InterruptController) InService() uint16 {
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+	return controller.inService
+}
+
+// Reset drops all pending interrupts and clears the in-service state.
+func (controller *InterruptController) Reset() {
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+	controller.pending = controller.pending[:0]
+	controller.inService = 0
+	atomic.StoreInt32(&controller.queued, 0)
+}
+
+// clone copies the pending and in-service state into a new controller.
+func (controller *InterruptController) clone() *InterruptController {
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+	pending := make([]asyncInterrupt, len(controller.pending), IR_QUEUE_SIZE)
+	copy(pending, controller.pending)
+	return &InterruptController{pending: pending, inService: controller.inService, queued: int32(len(pending))}
+}
+
+// next removes the highest priority deliverable interrupt from the queue.
+func (controller *InterruptController) next(mask uint16) (asyncInterrupt, bool) {
+	if atomic.LoadInt32(&controller.queued) == 0 {
+		return asyncInterrupt{}, false
+	}
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+	limit := IR_VECTORS
+	for vector := uint16(0); vector < IR_VECTORS; vector++ {
+		if controller.inService&(1<<vector) != 0 {
+			limit = vector
+			break
+		}
+	}
+	selected := -1
+	for index, ir := range controller.pending {
+		if ir.Vector >= limit || mask&(1<<ir.Vector) != 0 {
+			continue
+		}
+		if selected < 0 || ir.Vector < controller.pending[selected].Vector {
+			selected = index
+		}
+	}
+	if selected < 0 {
+		return asyncInterrupt{}, false
+	}
+	ir := controller.pending[selected]
+	controller.pending = append(controller.pending[:selected], controller.pending[selected+1:]...)
+	atomic.StoreInt32(&controller.queued, int32(len(controller.pending)))
+	return ir, true
+}
+
+// enter marks a vector as in service.
+func (controller *InterruptController) enter(vector uint16) {
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+	controller.inService |= 1 << vector
+}
+
+// complete ends the highest priority interrupt in service.
+func (controller *InterruptController) complete() {
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+	controller.inService &= controller.inService - 1
+}
@@ -0,0 +1,122 @@
+package vm
+
+import "testing"
+
+func TestInterruptCoalescing(t *testing.T) {
+	controller := NewInterruptController()
+	controller.Raise(1, VECTOR_KEYBOARD)
+	controller.Raise(2, VECTOR_KEYBOARD)
+	controller.Raise(1, VECTOR_KEYBOARD)
+	controller.Raise(1, VECTOR_OVERFLOW)
+	if pending := controller.Pending(); pending != 1<<VECTOR_KEYBOARD|1<<VECTOR_OVERFLOW {
+		t.Fatalf("pending = %04X", pending)
+	}
+	for _, want := range []asyncInterrupt{{1, VECTOR_KEYBOARD}, {2, VECTOR_KEYBOARD}, {1, VECTOR_OVERFLOW}} {
+		if ir, ok := controller.next(0); !ok || ir != want {
+			t.Fatalf("next = %v, %v, want %v", ir, ok, want)
+		}
+	}
+	if ir, ok := controller.next(0); ok {
+		t.Errorf("next = %v from empty queue", ir)
+	}
+}
+
+func TestInterruptQueueFull(t *testing.T) {
+	machine := newHeadless()
+	for code := uint16(0); code < IR_QUEUE_SIZE; code++ {
+		if !machine.Interrupt(code, VECTOR_KEYBOARD) {
+			t.Fatalf("interrupt %d dropped", code)
+		}
+	}
+	if machine.Interrupt(IR_QUEUE_SIZE, VECTOR_TIMER) {
+		t.Error("interrupt queued beyond capacity")
+	}
+	if !machine.Interrupt(0, VECTOR_KEYBOARD) {
+		t.Error("pending interrupt not coalesced in full queue")
+	}
+	if pending := machine.Interrupts().Pending(); pending != 1<<VECTOR_KEYBOARD {
+		t.Errorf("pending = %04X", pending)
+	}
+}
+
+func TestInterruptPriority(t *testing.T) {
+	controller := NewInterruptController()
+	controller.Raise(1, VECTOR_TIMER)
+	controller.Raise(2, VECTOR_KEYBOARD)
+	controller.Raise(3, VECTOR_STATE)
+	controller.Raise(3, VECTOR_STATE)
+	if pending := controller.Pending(); pending != 1<<VECTOR_STATE|1<<VECTOR_KEYBOARD|1<<VECTOR_TIMER {
+		t.Fatalf("pending = %04X", pending)
+	}
+	for _, c := range []struct {
+		name     string
+		mask     uint16
+		vector   uint16
+		ok       bool
+		complete bool
+	}{
+		{"masked state", 1 << VECTOR_STATE, VECTOR_KEYBOARD, true, false},
+		{"timer below keyboard", 1 << VECTOR_STATE, 0, false, false},
+		{"state preempts keyboard", 0, VECTOR_STATE, true, true},
+		{"keyboard still in service", 0, 0, false, true},
+		{"timer after IRET", 0, VECTOR_TIMER, true, false},
+		{"queue drained", 0, 0, false, false},
+	} {
+		ir, ok := controller.next(c.mask)
+		if ok != c.ok || ok && ir.Vector != c.vector {
+			t.Fatalf("%s: next = %v, %v", c.name, ir, ok)
+		}
+		if ok {
+			controller.enter(ir.Vector)
+		}
+		if c.complete {
+			controller.complete()
+		}
+	}
+	if inService := controller.InService(); inService != 1<<VECTOR_TIMER {
+		t.Errorf("in service %04X", inService)
+	}
+}
+
+func TestInterruptReturnOrder(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		mask uint16
+		want uint16
+	}{
+		{"nested by priority", 0, 0x12},
+		{"timer masked", 1 << VECTOR_TIMER, 0x1},
+	} {
+		machine := newHeadless()
+		load(t, machine,
+			FLAG_R|CMD_INC, REGISTER_AX,
+			FLAG_R|CMD_INC, REGISTER_AX,
+			CMD_HLT)
+		// each handler shifts its number into DX
+		for i, handler := range []uint16{0x2100, 0x2200} {
+			place(t, machine, handler,
+				FLAG_RI|CMD_SHL, REGISTER_DX, 4,
+				FLAG_RI|CMD_ADD, REGISTER_DX, uint16(i+1),
+				CMD_IRET)
+		}
+		place(t, machine, IR_KEYBOARD, 0x2100)
+		place(t, machine, IR_TIMER, 0x2200)
+		place(t, machine, IR_MASK, c.mask)
+		machine.Interrupt(0, VECTOR_TIMER)
+		machine.Interrupt(0, VECTOR_KEYBOARD)
+		if err := machine.run(); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		order, _ := machine.Load(REGISTER_DX)
+		counter, _ := machine.Load(REGISTER_AX)
+		if order != c.want || counter != 2 {
+			t.Errorf("%s: handlers %X, counter %d", c.name, order, counter)
+		}
+		if machine.interrupts.InService() != 0 {
+			t.Errorf("%s: in service %04X after IRET", c.name, machine.interrupts.InService())
+		}
+		if pending := machine.interrupts.Pending(); pending != c.mask {
+			t.Errorf("%s: pending %04X, want %04X", c.name, pending, c.mask)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package vm
+
+import "sync"
+
+// KeyEvent is a pressed key with its modifiers.
+type KeyEvent struct {
+	Key, Modifiers uint16
+}
+
+// present checks if the event holds a key, telling special key 0 apart from a cleared event.
+func (event KeyEvent) present() bool {
+	return event.Key != 0 || event.Modifiers&KEY_MOD_SPECIAL != 0
+}
+
+// Keyboard is a keyboard controller with a small hardware FIFO.
+// Key events are delivered to the program through the keyboard interrupt.
+type Keyboard struct {
+	mutex  sync.Mutex
+	events []KeyEvent
+}
+
+// NewKeyboard creates a new keyboard controller with an empty buffer.
+func NewKeyboard() *Keyboard {
+	return &Keyboard{events: make([]KeyEvent, 0, KEYBOARD_BUFFER)}
+}
+
+// Press queues a key event. If the buffer is full, the event is dropped and false is returned.
+// Character 0 is dropped as well, since it cannot be told apart from an acknowledged key;
+// special key 0 (Ctrl-Space) is kept apart by KEY_MOD_SPECIAL.
+func (keyboard *Keyboard) Press(event KeyEvent) bool {
+	keyboard.mutex.Lock()
+	defer keyboard.mutex.Unlock()
+	if !event.present() || len(keyboard.events) >= int(KEYBOARD_BUFFER) {
+		return false
+	}
+	keyboard.events = append(keyboard.events, event)
+	return true
+}
+
+// peek returns the oldest key event without removing it from the buffer.
+func (keyboard *Keyboard) peek() (KeyEvent, bool) {
+	keyboard.mutex.Lock()
+	defer keyboard.mutex.Unlock()
+	if len(keyboard.events) == 0 {
+		return KeyEvent{}, false
+	}
+	return keyboard.events[0], true
+}
+
+// next removes the oldest key event from the buffer.
+func (keyboard *Keyboard) next() (KeyEvent, bool) {
+	keyboard.mutex.Lock()
+	defer keyboard.mutex.Unlock()
+	if len(keyboard.events) == 0 {
+		return KeyEvent{}, false
+	}
+	event := keyboard.events[0]
+	keyboard.events = append(keyboard.events[:0], keyboard.events[1:]...)
+	return event, true
+}
+
+// step loads the next key event into the key registers once the program
+// has acknowledged the last key by clearing KEY_DATA and KEY_MODIFIERS and raises the keyboard interrupt.
+// Only the special key flag of KEY_MODIFIERS is checked, so handlers of character keys may leave it set.
+// While the interrupt queue is full, the key stays buffered and is retried on the next step.
+func (keyboard *Keyboard) step(machine *Machine) error {
+	var latched KeyEvent
+	var err error
+	latched.Key, err = machine.loadRegister(KEY_DATA)
+	if err != nil {
+		return err
+	}
+	latched.Modifiers, err = machine.loadRegister(KEY_MODIFIERS)
+	if err != nil {
+		return err
+	}
+	if latched.present() {
+		return nil
+	}
+	event, ok := keyboard.peek()
+	if !ok {
+		return nil
+	}
+	handler, err := machine.handler(VECTOR_KEYBOARD)
+	if err != nil {
+		return err
+	}
+	if handler == 0 || !machine.Interrupt(event.Key, VECTOR_KEYBOARD) {
+		return nil
+	}
+	keyboard.next()
+	err = machine.storeRegister(KEY_DATA, event.Key)
+	if err != nil {
+		return err
+	}
+	return machine.storeRegister(KEY_MODIFIERS, event.Modifiers)
+}
@@ -0,0 +1,135 @@
+package vm
+
+import (
+	"testing"
+
+	termbox "github.com/nsf/termbox-go"
+)
+
+func TestTranslateKey(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		event termbox.Event
+		want  KeyEvent
+	}{
+		{"character", termbox.Event{Ch: 'a'}, KeyEvent{'a', 0}},
+		{"alt character", termbox.Event{Ch: 'x', Mod: termbox.ModAlt}, KeyEvent{'x', KEY_MOD_ALT}},
+		{"enter", termbox.Event{Key: termbox.KeyEnter}, KeyEvent{0x0D, KEY_MOD_SPECIAL}},
+		{"arrow", termbox.Event{Key: termbox.KeyArrowUp}, KeyEvent{uint16(termbox.KeyArrowUp), KEY_MOD_SPECIAL}},
+		{"alt F1", termbox.Event{Key: termbox.KeyF1, Mod: termbox.ModAlt}, KeyEvent{uint16(termbox.KeyF1), KEY_MOD_SPECIAL | KEY_MOD_ALT}},
+		{"alt enter", termbox.Event{Key: termbox.KeyEnter, Mod: termbox.ModAlt}, KeyEvent{0x0D, KEY_MOD_SPECIAL | KEY_MOD_ALT}},
+		{"backspace", termbox.Event{Key: termbox.KeyBackspace2}, KeyEvent{0x7F, KEY_MOD_SPECIAL}},
+		{"ctrl space", termbox.Event{Key: termbox.KeyCtrlSpace}, KeyEvent{0, KEY_MOD_SPECIAL}},
+	} {
+		if got := translateKey(c.event); got != c.want {
+			t.Errorf("%s: translateKey = %+v, want %+v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestKeyboardBuffer(t *testing.T) {
+	keyboard := NewKeyboard()
+	if keyboard.Press(KeyEvent{}) {
+		t.Error("NUL character accepted")
+	}
+	if !keyboard.Press(translateKey(termbox.Event{Key: termbox.KeyCtrlSpace})) {
+		t.Error("Ctrl-Space dropped")
+	}
+	keyboard.next()
+	for i := uint16(0); i < KEYBOARD_BUFFER; i++ {
+		if !keyboard.Press(KeyEvent{Key: 'a' + i}) {
+			t.Fatalf("key %d dropped", i)
+		}
+	}
+	if keyboard.Press(KeyEvent{Key: 'z'}) {
+		t.Error("key accepted by full buffer")
+	}
+	for i := uint16(0); i < KEYBOARD_BUFFER; i++ {
+		if event, ok := keyboard.next(); !ok || event.Key != 'a'+i {
+			t.Fatalf("next = %+v, %v, want %c", event, ok, 'a'+i)
+		}
+	}
+	if _, ok := keyboard.next(); ok {
+		t.Error("event from empty buffer")
+	}
+}
+
+func TestKeyboardInterrupt(t *testing.T) {
+	// MOV handler IR_KEYBOARD; loop: JMP loop; handler: MOV KEY_DATA BX; MOV KEY_MODIFIERS CX; HLT
+	program := bytecode(
+		FLAG_IR|CMD_MOV, CODE_BASE+10, IR_KEYBOARD,
+		FLAG_I|CMD_JMP, CODE_BASE+6,
+		FLAG_RR|CMD_MOV, KEY_DATA, REGISTER_BX,
+		FLAG_RR|CMD_MOV, KEY_MODIFIERS, REGISTER_CX,
+		CMD_HLT,
+	)
+	machine := newHeadless()
+	machine.Keyboard().Press(KeyEvent{'q', KEY_MOD_ALT})
+	if err := machine.Boot(program); err != nil {
+		t.Fatal(err)
+	}
+	bx, _ := machine.Load(REGISTER_BX)
+	cx, _ := machine.Load(REGISTER_CX)
+	if bx != 'q' || cx != KEY_MOD_ALT {
+		t.Errorf("key %04X with modifiers %04X, want %04X, %04X", bx, cx, 'q', KEY_MOD_ALT)
+	}
+}
+
+func TestKeyboardRetry(t *testing.T) {
+	machine := newHeadless()
+	load(t, machine)
+	machine.Store(IR_KEYBOARD, CODE_BASE)
+	for code := uint16(0); code < IR_QUEUE_SIZE; code++ {
+		machine.Interrupt(code, VECTOR_TIMER)
+	}
+	machine.keyboard.Press(KeyEvent{'a', 1})
+	if err := machine.keyboard.step(machine); err != nil {
+		t.Fatal(err)
+	}
+	if key, _ := machine.Load(KEY_DATA); key != 0 {
+		t.Fatalf("key %04X latched with a full interrupt queue", key)
+	}
+	machine.Interrupts().Reset()
+	if err := machine.keyboard.step(machine); err != nil {
+		t.Fatal(err)
+	}
+	key, _ := machine.Load(KEY_DATA)
+	modifiers, _ := machine.Load(KEY_MODIFIERS)
+	if key != 'a' || modifiers != 1 {
+		t.Errorf("key = %04X, modifiers = %04X after retry", key, modifiers)
+	}
+	if pending := machine.Interrupts().Pending(); pending != 1<<VECTOR_KEYBOARD {
+		t.Errorf("pending = %04X", pending)
+	}
+	if _, ok := machine.keyboard.peek(); ok {
+		t.Error("key still buffered after delivery")
+	}
+}
+
+func TestKeyboardSpecialZero(t *testing.T) {
+	machine := newHeadless()
+	load(t, machine)
+	machine.Store(IR_KEYBOARD, CODE_BASE)
+	machine.keyboard.Press(KeyEvent{0, KEY_MOD_SPECIAL})
+	machine.keyboard.Press(KeyEvent{'b', 0})
+	if err := machine.keyboard.step(machine); err != nil {
+		t.Fatal(err)
+	}
+	if modifiers, _ := machine.Load(KEY_MODIFIERS); modifiers != KEY_MOD_SPECIAL {
+		t.Fatalf("modifiers = %04X, want Ctrl-Space latched", modifiers)
+	}
+	machine.Interrupts().Reset()
+	if err := machine.keyboard.step(machine); err != nil {
+		t.Fatal(err)
+	}
+	if key, _ := machine.Load(KEY_DATA); key != 0 {
+		t.Fatalf("key %04X replaced unacknowledged Ctrl-Space", key)
+	}
+	machine.Store(KEY_MODIFIERS, 0)
+	if err := machine.keyboard.step(machine); err != nil {
+		t.Fatal(err)
+	}
+	if key, _ := machine.Load(KEY_DATA); key != 'b' {
+		t.Errorf("key = %04X after acknowledging Ctrl-Space, want %04X", key, 'b')
+	}
+}
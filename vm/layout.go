@@ -0,0 +1,219 @@
+package vm
+
+import "fmt"
+
+// Layout describes the memory regions of a machine.
+type Layout struct {
+	// Bytes of RAM mapped from address zero, at most MAX_MEMORY+1
+	Memory int
+	// Default load address of programs
+	CodeBase uint16
+	// First and last address of the stack
+	StackBase, StackMax uint16
+	// Start of the display region holding characters, palette and mode
+	Display uint16
+	// Initial base of the interrupt vector table
+	Vectors uint16
+}
+
+// DefaultLayout is the layout of machines created without options.
+var DefaultLayout = Layout{
+	Memory:    int(MAX_MEMORY) + 1,
+	CodeBase:  CODE_BASE,
+	StackBase: STACK_BASE,
+	StackMax:  STACK_MAX,
+	Display:   OUT_CHARS,
+	Vectors:   IR_STATE,
+}
+
+// chars returns the address of the character cells.
+func (layout Layout) chars() uint16 {
+	return layout.Display
+}
+
+// colors returns the address of the palette.
+func (layout Layout) colors() uint16 {
+	return layout.Display + OUT_COLORS - OUT_CHARS
+}
+
+// mode returns the address of the display mode.
+func (layout Layout) mode() uint16 {
+	return layout.Display + OUT_MODE - OUT_CHARS
+}
+
+// Regions returns the named regions of the layout.
+func (layout Layout) Regions() []Region {
+	return []Region{
+		{"registers", CODE_POINTER, REGISTER_FILE_END - 1},
+		{"vectors", layout.Vectors, layout.Vectors + IR_VECTORS*WORD_SIZE - 1},
+		{"control", IR_BASE, SYSTEM_INFO - 1},
+		{"system", SYSTEM_INFO, SYSTEM_INFO + SYSTEM_INFO_SIZE - 1},
+		{"stack", layout.StackBase, layout.StackMax},
+		{"display", layout.Display, layout.Display + DISPLAY_SIZE - 1},
+		{"code", layout.CodeBase, uint16(layout.Memory - 1)},
+	}
+}
+
+// Validate checks that all regions fit into memory and do not overlap.
+// The code region extends up to the next region or the end of memory.
+// The vector table may start in the register file behind the interrupt value.
+func (layout Layout) Validate() error {
+	return layout.validate(nil)
+}
+
+// validate checks the layout together with the regions of devices attached to a machine.
+// Devices may be mapped beyond the end of memory.
+func (layout Layout) validate(devices []Region) error {
+	if layout.Memory <= int(SYSTEM_INFO+SYSTEM_INFO_SIZE) || layout.Memory > int(MAX_MEMORY)+1 {
+		return fmt.Errorf("invalid memory size %d", layout.Memory)
+	}
+	if int(layout.StackMax) < int(layout.StackBase)+int(STACK_RESERVE) {
+		return fmt.Errorf("stack %4.4X - %4.4X is too small", layout.StackBase, layout.StackMax)
+	}
+	regions := layout.Regions()
+	fixed, code := regions[:len(regions)-1:len(regions)-1], regions[len(regions)-1]
+	for _, region := range fixed {
+		if region.Last < region.First || int(region.Last) >= layout.Memory {
+			return fmt.Errorf("%s region %4.4X - %4.4X exceeds memory", region.Name, region.First, region.Last)
+		}
+	}
+	fixed = append(fixed, devices...)
+	for i, region := range fixed {
+		for _, other := range fixed[i+1:] {
+			if region.Name == "registers" && other.Name == "vectors" && other.First >= IR_STATE {
+				continue
+			}
+			if region.First <= other.Last && other.First <= region.Last {
+				return fmt.Errorf("%s region overlaps %s region", region.Name, other.Name)
+			}
+		}
+		if code.First >= region.First && code.First <= region.Last {
+			return fmt.Errorf("code base %4.4X lies in %s region", code.First, region.Name)
+		}
+	}
+	if int(code.First) >= layout.Memory {
+		return fmt.Errorf("code base %4.4X exceeds memory", code.First)
+	}
+	return nil
+}
+
+// devices returns the regions of the bank window and the NVRAM attached to the machine.
+func (machine *Machine) devices() []Region {
+	var regions []Region
+	if machine.banks != nil {
+		first, last := machine.banks.Window()
+		regions = append(regions, Region{"banks", first, last})
+	}
+	if machine.nvram != nil {
+		last := machine.nvramBase + uint16(machine.nvram.Size()-1)
+		regions = append(regions, Region{"nvram", machine.nvramBase, last})
+	}
+	return regions
+}
+
+// systemInfo is the read-only system information block describing the machine to programs.
+type systemInfo struct {
+	machine *Machine
+}
+
+// word returns a word of the system information block.
+func (info systemInfo) word(offset uint16) uint16 {
+	layout := info.machine.layout
+	switch offset {
+	case SYSINFO_MEMORY:
+		return uint16(layout.Memory - 1)
+	case SYSINFO_CODE_BASE:
+		return layout.CodeBase
+	case SYSINFO_STACK_BASE:
+		return layout.StackBase
+	case SYSINFO_STACK_MAX:
+		return layout.StackMax
+	case SYSINFO_DISPLAY:
+		return layout.Display
+	case SYSINFO_VECTORS:
+		return layout.Vectors
+	case SYSINFO_VERSION:
+		return ISA_VERSION
+	case SYSINFO_FEATURES:
+		return uint16(info.machine.features)
+	}
+	return 0
+}
+
+// Load fetches a word from the system information block.
+func (info systemInfo) Load(offset uint16) (uint16, error) {
+	if offset+1 >= SYSTEM_INFO_SIZE {
+		return 0, &OutOfRangeError{offset}
+	}
+	if offset%WORD_SIZE != 0 {
+		return info.word(offset-1)<<8 | info.word(offset+1)>>8, nil
+	}
+	return info.word(offset), nil
+}
+
+// Store rejects writes to the system information block.
+func (info systemInfo) Store(offset, value uint16) error {
+	return &ReadOnlyError{offset}
+}
+
+// StoreByte rejects writes to the system information block.
+func (info systemInfo) StoreByte(offset uint16, value byte) error {
+	return &ReadOnlyError{offset}
+}
+
+// Option configures a machine created by New.
+type Option func(machine *Machine)
+
+// WithLayout replaces the whole memory layout.
+func WithLayout(layout Layout) Option {
+	return func(machine *Machine) {
+		machine.layout = layout
+	}
+}
+
+// WithMemory sets the size of the RAM in bytes.
+func WithMemory(size int) Option {
+	return func(machine *Machine) {
+		machine.layout.Memory = size
+	}
+}
+
+// WithCodeBase sets the default load address of programs.
+func WithCodeBase(base uint16) Option {
+	return func(machine *Machine) {
+		machine.layout.CodeBase = base
+	}
+}
+
+// WithStack sets the first and last address of the stack.
+func WithStack(base, max uint16) Option {
+	return func(machine *Machine) {
+		machine.layout.StackBase, machine.layout.StackMax = base, max
+	}
+}
+
+// WithDisplay sets the start of the display region.
+func WithDisplay(base uint16) Option {
+	return func(machine *Machine) {
+		machine.layout.Display = base
+	}
+}
+
+// WithVectors sets the initial base of the interrupt vector table.
+func WithVectors(base uint16) Option {
+	return func(machine *Machine) {
+		machine.layout.Vectors = base
+	}
+}
+
+// WithFeatures enables exactly the given extensions.
+func WithFeatures(features Features) Option {
+	return func(machine *Machine) {
+		machine.SetFeatures(features)
+	}
+}
+
+// Layout returns the memory layout of the machine.
+func (machine *Machine) Layout() Layout {
+	return machine.layout
+}
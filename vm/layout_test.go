@@ -0,0 +1,49 @@
+package vm
+
+import "testing"
+
+func TestLayoutValidate(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		opts  []Option
+		valid bool
+	}{
+		{"default", nil, true},
+		{"relocated", []Option{WithCodeBase(0x4000), WithStack(0x3000, 0x30FF), WithVectors(0x200)}, true},
+		{"stack in display", []Option{WithStack(0x1800, 0x18FF)}, false},
+		{"code in stack", []Option{WithCodeBase(0x0100)}, false},
+		{"display beyond memory", []Option{WithMemory(0x1800)}, false},
+		{"vectors in control", []Option{WithVectors(0x40)}, false},
+		{"vectors over registers", []Option{WithVectors(0x08)}, false},
+		{"small stack", []Option{WithStack(0x300, 0x301)}, false},
+	} {
+		machine := New(c.opts...)
+		err := machine.layout.validate(machine.devices())
+		if (err == nil) != c.valid {
+			t.Errorf("%s: validate() = %v", c.name, err)
+		}
+	}
+}
+
+func TestLayoutValidateDevices(t *testing.T) {
+	machine := newHeadless(WithDisplay(0xB000))
+	if err := machine.AttachNVRAM(NewNVRAM(t.TempDir()+"/save.nv", int(NVRAM_SIZE)), NVRAM_BASE); err != nil {
+		t.Fatal(err)
+	}
+	if err := machine.layout.validate(machine.devices()); err == nil {
+		t.Error("NVRAM overlapping the display accepted")
+	}
+	machine = newHeadless(WithStack(0xC000, 0xC0FF))
+	machine.AttachBanks(NewBankController(nil, BANK_SIZE_16K, BANK_WINDOW))
+	if err := machine.BootAt([]byte{0x00, byte(CMD_HLT)}, CODE_BASE); err == nil {
+		t.Error("bank window overlapping the stack accepted")
+	}
+}
+
+func TestRegionsCoverRegisterFile(t *testing.T) {
+	for _, addr := range []uint16{CODE_POINTER, INTERRUPT, REGISTER_FILE_END - 1} {
+		if name := region(Regions, addr); name != "registers" {
+			t.Errorf("region(%04X) = %q", addr, name)
+		}
+	}
+}
@@ -4,6 +4,9 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var (
@@ -20,6 +23,14 @@ var (
 		0xFF0, // Yellow
 		0xF0F, // Fuchsia
 		0x0FF, // Aqua
+		0x888, // Gray
+		0xCCC, // Silver
+		0x800, // Maroon
+		0x080, // Dark green
+		0x008, // Navy
+		0x880, // Olive
+		0x808, // Purple
+		0x088, // Teal
 	}
 	FlagSize = map[uint16]int{
 		FLAG_RR:   2,
@@ -29,15 +40,17 @@ var (
 		FLAG_AR:   2,
 		FLAG_IA:   2,
 		FLAG_IR:   2,
+		FLAG_II:   2,
 		FLAG_I:    1,
 		FLAG_R:    1,
+		FLAG_P:    1,
 		FLAG_NONE: 0,
 	}
 )
 
-type asyncInterrupt struct {
-	Identifier, Reason uint16
-}
+// BreakHandler is called when the machine executes a BRK instruction.
+// The machine continues if the handler returns true, otherwise it halts.
+type BreakHandler func(machine *Machine) bool
 
 // Machine is a sixteen bit virtual machine.
 type Machine struct {
@@ -46,10 +59,40 @@ type Machine struct {
 	flag        uint16
 	command     uint16
 	args        [MAX_CMD_ARGS]uint16
-	keepRunning bool
+	keepRunning int32
 	debug       bool
 	display     Display
-	irQueue     chan asyncInterrupt
+	interrupts  *InterruptController
+	onBreak     BreakHandler
+	compact     bool
+	features    Features
+	keyboard    *Keyboard
+	bus         *Bus
+	banks       *BankController
+	nvram       *NVRAM
+	nvramBase   uint16
+	restored    bool
+	timer       Timer
+	policies    [faultCount]FaultPolicy
+	reserved    bool
+	overflowed  bool
+	mutex       sync.Mutex
+	powerOff    *time.Timer
+	current     uint16
+	protection  protection
+	paging      paging
+	registers   registerFile
+	frame       *frameBuffer
+	rendering   chan struct{}
+	rendered    chan struct{}
+	layout      Layout
+	observed    bool
+	executing   bool
+	// bus version and ownership of the register addresses, see ownsRegisters
+	registerVersion uint32
+	registersOwned  bool
+	registerMapping Mapping
+	controlMapping  Mapping
 }
 
 // machineError is a generic machine error.
@@ -62,12 +105,51 @@ func (me machineError) Error() string {
 	return me.prefix + ": " + me.source.Error()
 }
 
-// New instantiates a new virtual machine.
-func New() *Machine {
-	return &Machine{
-		Memory:  NewMemory(int(MAX_MEMORY) + 1),
-		display: TextDisplay{},
-	}
+func (me machineError) Unwrap() error {
+	return me.source
+}
+
+// New instantiates a new virtual machine with the default layout modified by the options.
+// An invalid layout is reported when the machine boots.
+func New(opts ...Option) *Machine {
+	keyboard := NewKeyboard()
+	bus := NewBus()
+	machine := &Machine{
+		Memory:     NewSyncMemory(bus),
+		bus:        bus,
+		display:    TextDisplay{TermboxDisplay{keyboard}},
+		features:   FEATURE_ALL,
+		keyboard:   keyboard,
+		interrupts: NewInterruptController(),
+		frame:      &frameBuffer{bitmap: true},
+		layout:     DefaultLayout,
+		// armed before the host can halt the machine, e.g. on a signal
+		keepRunning: 1,
+	}
+	for _, opt := range opts {
+		opt(machine)
+	}
+	if size := machine.layout.Memory; size > 0 && size <= int(MAX_MEMORY)+1 {
+		bus.Map(0, uint16(size-1), NewCOWMemory(size))
+	}
+	if display := machine.layout.Display; int(display)+int(DISPLAY_SIZE) <= machine.layout.Memory {
+		bus.Map(display, display+DISPLAY_SIZE-1, machine.frame)
+	}
+	machine.registerMapping = bus.Map(CODE_POINTER, REGISTER_FILE_END-1, &machine.registers)
+	machine.controlMapping = bus.Map(IR_BASE, CONTROL_FILE_END-1, controlRegisters{&machine.registers})
+	bus.Map(SYSTEM_INFO, SYSTEM_INFO+SYSTEM_INFO_SIZE-1, systemInfo{machine})
+	return machine
+}
+
+// Bus returns the device bus of the machine, initially mapping RAM from address zero up to
+// the memory size of its layout (see WithMemory) and the display, register file and system information on top.
+func (machine *Machine) Bus() *Bus {
+	return machine.bus
+}
+
+// Keyboard returns the keyboard controller of the machine.
+func (machine *Machine) Keyboard() *Keyboard {
+	return machine.keyboard
 }
 
 // EnableDebug prints verbose debugging logs.
@@ -75,13 +157,44 @@ func (machine *Machine) EnableDebug(debug bool) {
 	machine.debug = debug
 }
 
-// Boot copies the bytecode into the program segment and starts the virtual machine.
+// SetDisplay replaces the display the machine draws to, e.g. by a headless display.
+func (machine *Machine) SetDisplay(display Display) {
+	machine.display = display
+}
+
+// SetBreakHandler sets the handler invoked on BRK instructions.
+func (machine *Machine) SetBreakHandler(handler BreakHandler) {
+	machine.onBreak = handler
+}
+
+// Boot copies the bytecode to the code base of the layout and starts the virtual machine.
 func (machine *Machine) Boot(code []byte) error {
-	err := machine.initialize()
+	return machine.BootAt(code, machine.layout.CodeBase)
+}
+
+// BootAt copies position-independent bytecode to the given base address and starts the virtual machine.
+// The display is closed once the machine stops, even if the program fails.
+func (machine *Machine) BootAt(code []byte, base uint16) error {
+	image, err := DecodeImage(code, FORMAT_RAW, base)
+	if err != nil {
+		return err
+	}
+	return machine.BootImage(image)
+}
+
+// BootImage loads the blocks of a program image and starts the virtual machine at its entry point.
+// The display is closed once the machine stops, even if the program fails.
+func (machine *Machine) BootImage(image Image) (err error) {
+	err = machine.initialize()
+	defer func() {
+		if disposeErr := machine.dispose(); err == nil {
+			err = disposeErr
+		}
+	}()
 	if err != nil {
 		return err
 	}
-	err = machine.program(code)
+	err = machine.program(image)
 	if err != nil {
 		return err
 	}
@@ -89,22 +202,89 @@ func (machine *Machine) Boot(code []byte) error {
 	if err != nil {
 		return err
 	}
-	err = machine.dispose()
+	return nil
+}
+
+// Resume continues executing a stopped machine from its current state,
+// e.g. after a HLT or a fork.
+func (machine *Machine) Resume() (err error) {
+	err = machine.display.Init()
+	defer func() {
+		if disposeErr := machine.dispose(); err == nil {
+			err = disposeErr
+		}
+	}()
 	if err != nil {
 		return err
 	}
-	return nil
+	machine.timer.last = time.Now()
+	return machine.run()
 }
 
-// dispose dispatches all resources from the virtual machine.
+// dispose dispatches all resources from the virtual machine
+// and arms it for the next boot, keeping halts requested until then.
 func (machine *Machine) dispose() error {
+	machine.mutex.Lock()
+	if machine.powerOff != nil {
+		machine.powerOff.Stop()
+		machine.powerOff = nil
+	}
+	machine.mutex.Unlock()
+	atomic.StoreInt32(&machine.keepRunning, 1)
 	machine.display.Close()
-	return nil
+	return machine.flushNVRAM()
 }
 
-// Interrupt sends a interrupt event to the virtual machine.
-func (machine *Machine) Interrupt(code, reason uint16) {
-	machine.irQueue <- asyncInterrupt{code, reason}
+// PowerOff raises the power-off interrupt on the state vector and halts the machine
+// once the grace period has passed. Without a state handler or while a power-off is already
+// pending, the machine halts immediately. It is safe to call from other goroutines.
+func (machine *Machine) PowerOff(grace time.Duration) {
+	machine.mutex.Lock()
+	pending := machine.powerOff != nil
+	machine.mutex.Unlock()
+	if pending {
+		machine.Halt()
+		return
+	}
+	handler, err := machine.handler(VECTOR_STATE)
+	if err != nil || handler == 0 || !machine.Interrupt(IR_STATE_POWER_OFF, VECTOR_STATE) {
+		machine.Halt()
+		return
+	}
+	machine.mutex.Lock()
+	defer machine.mutex.Unlock()
+	if machine.powerOff == nil {
+		machine.powerOff = time.AfterFunc(grace, machine.Halt)
+	}
+}
+
+// setExecuting marks the machine as executing, see Observe.
+func (machine *Machine) setExecuting(executing bool) {
+	machine.mutex.Lock()
+	defer machine.mutex.Unlock()
+	machine.executing = executing
+}
+
+// running checks if the machine has not been halted.
+func (machine *Machine) running() bool {
+	return atomic.LoadInt32(&machine.keepRunning) != 0
+}
+
+// Interrupt sends a interrupt event on the given vector to the virtual machine.
+// It is safe to call from other goroutines and never blocks.
+// It reports false if the interrupt queue is full and the interrupt has been dropped.
+func (machine *Machine) Interrupt(code, vector uint16) bool {
+	return machine.interrupts.Raise(code, vector)
+}
+
+// Timer returns the interval timer of the machine, e.g. to read its tick counter while the machine runs.
+func (machine *Machine) Timer() *Timer {
+	return &machine.timer
+}
+
+// Interrupts returns the interrupt controller of the machine.
+func (machine *Machine) Interrupts() *InterruptController {
+	return machine.interrupts
 }
 
 // interruptError creates a generic interrupt error.
@@ -112,46 +292,67 @@ func interruptError(sub error) error {
 	return &machineError{"interrupt", sub}
 }
 
-// updateInterrupts handles the latest interrupt.
-func (machine *Machine) updateInterrupts() error {
-	var code, reason uint16
+// handler loads the interrupt handler of a vector from the vector table.
+// The table is read physically, so it is safe to call while the program changes
+// permissions or page tables, e.g. from PowerOff.
+func (machine *Machine) handler(vector uint16) (uint16, error) {
+	base, err := machine.loadRegister(IR_BASE)
+	if err != nil {
+		return 0, err
+	}
+	return machine.Memory.Load(base + vector*WORD_SIZE)
+}
 
-	// Fetch latest interrupt
-	select {
-	case ir, ok := <-machine.irQueue:
-		if !ok {
-			return interruptError(errors.New("queue closed"))
-		}
-		code = ir.Identifier
-		reason = ir.Reason
-	default:
+// updateInterrupts handles the highest priority pending interrupt.
+// Faults raised while delivering it are handled like faults of a command.
+func (machine *Machine) updateInterrupts() error {
+	mask, err := machine.loadRegister(IR_MASK)
+	if err != nil {
+		return interruptError(err)
+	}
+	ir, ok := machine.interrupts.next(mask)
+	if !ok {
 		return nil
 	}
+	// Faults during delivery drop the interrupt and restart at the interrupted command
+	machine.current, err = machine.loadRegister(CODE_POINTER)
+	if err != nil {
+		return interruptError(err)
+	}
+	return machine.deliver(ir.Identifier, ir.Vector)
+}
 
-	// Store active code pointer on stack
-	current, err := machine.Load(CODE_POINTER)
+// deliver jumps to the interrupt handler of the vector.
+// Interrupts without a handler are ignored.
+func (machine *Machine) deliver(code, vector uint16) error {
+	// Load interrupt handler
+	pointer, err := machine.handler(vector)
 	if err != nil {
 		return interruptError(err)
 	}
-	err = machine.push(current)
+	if pointer == 0 {
+		return nil
+	}
+	// Store active code pointer on stack
+	current, err := machine.loadRegister(CODE_POINTER)
 	if err != nil {
 		return interruptError(err)
 	}
-	// Store interrupt code in register
-	err = machine.Store(INTERRUPT, code)
+	err = machine.push(current)
 	if err != nil {
 		return interruptError(err)
 	}
-	// Load interrupt handler
-	pointer, err := machine.Load(reason)
+	// Store interrupt code in register
+	err = machine.storeRegister(INTERRUPT, code)
 	if err != nil {
 		return interruptError(err)
 	}
 	// Jump to interrupt handler
-	err = machine.Store(CODE_POINTER, pointer)
+	err = machine.storeRegister(CODE_POINTER, pointer)
 	if err != nil {
 		return interruptError(err)
 	}
+	machine.interrupts.enter(vector)
 	return nil
 }
 
@@ -161,21 +362,25 @@ func stackError(sub error) error {
 }
 
 // push puts a value onto the stack.
+// The last STACK_RESERVE bytes of the stack are reserved for delivering faults.
 func (machine *Machine) push(value uint16) error {
-	stackItem, err := machine.Load(STACK_POINTER)
+	stackItem, err := machine.loadRegister(STACK_POINTER)
 	if err != nil {
 		return stackError(err)
 	}
-	if stackItem > STACK_MAX-WORD_SIZE {
-		machine.Interrupt(IR_OVERFLOW_STACK, IR_OVERFLOW)
-		return stackError(errors.New("memory overflow"))
+	limit := machine.layout.StackMax - STACK_RESERVE
+	if machine.reserved {
+		limit = machine.layout.StackMax
+	}
+	if stackItem > limit-WORD_SIZE {
+		return stackError(&FaultError{Fault: FAULT_STACK_OVERFLOW, Address: stackItem})
 	}
 	nextItem := stackItem + WORD_SIZE
 	err = machine.Store(nextItem, value)
 	if err != nil {
 		return stackError(err)
 	}
-	machine.Store(STACK_POINTER, nextItem)
+	err = machine.storeRegister(STACK_POINTER, nextItem)
 	if err != nil {
 		return stackError(err)
 	}
@@ -186,10 +391,13 @@ func (machine *Machine) push(value uint16) error {
 func (machine *Machine) pop() (uint16, error) {
 	var value uint16
 
-	pointer, err := machine.Load(STACK_POINTER)
+	pointer, err := machine.loadRegister(STACK_POINTER)
 	if err != nil {
 		return value, stackError(err)
 	}
+	if pointer <= machine.layout.StackBase {
+		return value, stackError(&FaultError{Fault: FAULT_STACK_UNDERFLOW, Address: pointer})
+	}
 	value, err = machine.Load(pointer)
 	if err != nil {
 		return value, stackError(err)
@@ -198,10 +406,7 @@ func (machine *Machine) pop() (uint16, error) {
 	if err != nil {
 		return value, stackError(err)
 	}
-	if pointer <= STACK_BASE {
-		return value, nil
-	}
-	err = machine.Store(STACK_POINTER, pointer-WORD_SIZE)
+	err = machine.storeRegister(STACK_POINTER, pointer-WORD_SIZE)
 	if err != nil {
 		return value, stackError(err)
 	}
@@ -210,19 +415,22 @@ func (machine *Machine) pop() (uint16, error) {
 
 // fetchWord handles the next command word.
 func (machine *Machine) fetchWord() (uint16, error) {
-	pointer, err := machine.Load(CODE_POINTER)
+	pointer, err := machine.loadRegister(CODE_POINTER)
 	if err != nil {
 		return 0, err
 	}
 	if pointer > MAX_MEMORY-WORD_SIZE {
-		machine.Interrupt(IR_OVERFLOW_CODE, IR_OVERFLOW)
-		return 0, errors.New("out of memory")
+		return 0, &FaultError{Fault: FAULT_CODE_OVERFLOW, Address: pointer}
 	}
-	err = machine.Store(CODE_POINTER, pointer+WORD_SIZE)
+	err = machine.checkExecute(pointer)
 	if err != nil {
 		return 0, err
 	}
-	word, err := machine.Load(pointer)
+	err = machine.storeRegister(CODE_POINTER, pointer+WORD_SIZE)
+	if err != nil {
+		return 0, err
+	}
+	word, err := machine.paging.fetch(machine.Memory, pointer)
 	if err != nil {
 		return 0, err
 	}
@@ -231,6 +439,10 @@ func (machine *Machine) fetchWord() (uint16, error) {
 
 // handle executes the current command.
 func (machine *Machine) handle() error {
+	if !machine.supports() {
+		return fmt.Errorf("unsupported command %4.4X", machine.next)
+	}
+
 	var err error
 	switch machine.command {
 	case CMD_ADD:
@@ -279,24 +491,45 @@ func (machine *Machine) handle() error {
 		err = machine.PerformCall()
 	case CMD_RET:
 		err = machine.PerformReturn()
+	case CMD_IRET:
+		err = machine.PerformInterruptReturn()
 	case CMD_HLT:
 		machine.Halt()
+	case CMD_BRK:
+		machine.PerformBreak()
+	case CMD_CPUID:
+		err = machine.PerformIdentify()
+	case CMD_XCHG:
+		err = machine.PerformExchange()
+	case CMD_CMPXCHG:
+		err = machine.PerformCompareExchange()
+	case CMD_PROT:
+		err = machine.PerformProtect()
+	case CMD_SPT:
+		err = machine.PerformSetPageTable()
 	}
 	return err
 }
 
 // parseState fetches command arguments from memory.
 func (machine *Machine) parseState() error {
-	machine.flag = machine.next & FLAG_MASK
-	machine.command = machine.next & CMD_MASK
-
 	var err error
-	maxFlags := FlagSize[machine.flag]
-	for i := 0; i < maxFlags; i++ {
-		machine.args[i], err = machine.fetchWord()
+	if machine.compact {
+		err = machine.parseCompactState()
 		if err != nil {
 			return err
 		}
+	} else {
+		machine.flag = machine.next & FLAG_MASK
+		machine.command = machine.next & CMD_MASK
+
+		maxFlags := FlagSize[machine.flag]
+		for i := 0; i < maxFlags; i++ {
+			machine.args[i], err = machine.fetchWord()
+			if err != nil {
+				return err
+			}
+		}
 	}
 
 	if machine.debug {
@@ -314,12 +547,12 @@ func iterationError(sub error) error {
 // iterate increases the code pointer and fetches the next command.
 func (machine *Machine) iterate() error {
 	var err error
+	machine.current, err = machine.loadRegister(CODE_POINTER)
+	if err != nil {
+		return iterationError(err)
+	}
 	if machine.debug {
-		pointer, err := machine.Load(CODE_POINTER)
-		if err != nil {
-			return iterationError(err)
-		}
-		fmt.Printf("%4.4X: ", pointer)
+		fmt.Printf("%4.4X: ", machine.current)
 	}
 
 	machine.next, err = machine.fetchWord()
@@ -334,38 +567,76 @@ func runtimeError(sub error) error {
 	return &machineError{"runtime", sub}
 }
 
-// run executes the current program code.
-func (machine *Machine) run() error {
+// step fetches and executes the next command.
+func (machine *Machine) step() error {
 	err := machine.iterate()
 	if err != nil {
-		return runtimeError(err)
+		return err
 	}
+	err = machine.parseState()
+	if err != nil {
+		return iterationError(err)
+	}
+	return machine.handle()
+}
 
-	for machine.keepRunning {
-		machine.parseState()
-		err = machine.handle()
+// run executes the current program code.
+// The display is refreshed on its own schedule meanwhile.
+func (machine *Machine) run() error {
+	machine.setExecuting(true)
+	defer machine.setExecuting(false)
+	machine.startRendering()
+	defer machine.stopRendering()
+	for machine.running() {
+		err := machine.step()
 		if err != nil {
-			return runtimeError(err)
+			err = machine.recoverFault(err)
+			if err != nil {
+				return runtimeError(err)
+			}
+		} else {
+			machine.leaveOverflow()
 		}
-		err = machine.updateInterrupts()
+		if machine.nvram != nil {
+			machine.nvram.flushRequested()
+		}
+		err = machine.timer.step(machine)
 		if err != nil {
 			return runtimeError(err)
 		}
-		err = machine.iterate()
+		err = machine.keyboard.step(machine)
 		if err != nil {
 			return runtimeError(err)
 		}
-		machine.display.Draw(80, 24, machine.Segment(OUT_CHARS, OUT_MODE))
+		err = machine.updateInterrupts()
+		if err != nil {
+			err = machine.recoverFault(err)
+			if err != nil {
+				return runtimeError(err)
+			}
+		}
 	}
 	return nil
 }
 
-// program loads the bytecode into command-memory.
-func (machine *Machine) program(code []byte) error {
-	size := len(code)
+// program loads the blocks of an image into memory and points the code pointer at its entry.
+// Like all host setup, loading ignores page permissions.
+func (machine *Machine) program(image Image) error {
+	machine.compact = image.Compact
+	if machine.compact && !machine.features.Has(FEATURE_COMPACT) {
+		return errors.New("compact encoding not supported")
+	}
 
-	for i := 0; i < size; i++ {
-		err := machine.StoreByte(CODE_BASE+uint16(i), code[i])
+	err := machine.Memory.Store(CODE_POINTER, image.Entry)
+	if err != nil {
+		return err
+	}
+	err = machine.Memory.Store(image.Entry, CMD_HLT)
+	if err != nil {
+		return err
+	}
+	for _, block := range image.Blocks {
+		err = machine.place(block)
 		if err != nil {
 			return err
 		}
@@ -375,62 +646,53 @@ func (machine *Machine) program(code []byte) error {
 
 // initialize sets the virtual machine to startup defaults.
 func (machine *Machine) initialize() error {
-	machine.display.Init()
-	// Load base values
-	err := machine.Store(CODE_POINTER, CODE_BASE)
+	err := machine.layout.validate(machine.devices())
+	if err != nil {
+		return err
+	}
+	err = machine.display.Init()
+	if err != nil {
+		return err
+	}
+	machine.timer.reset()
+	err = machine.restoreNVRAM()
 	if err != nil {
 		return err
 	}
-	err = machine.Store(STACK_POINTER, STACK_BASE)
+	// Load base values
+	err = machine.Memory.Store(STACK_POINTER, machine.layout.StackBase)
 	if err != nil {
 		return err
 	}
-	err = machine.Store(CODE_BASE, CMD_HLT)
+	err = machine.Memory.Store(INTERRUPT, MAX_MEMORY)
 	if err != nil {
 		return err
 	}
-	err = machine.Store(INTERRUPT, MAX_MEMORY)
+	err = machine.Memory.Store(IR_BASE, machine.layout.Vectors)
 	if err != nil {
 		return err
 	}
+	machine.interrupts.Reset()
+	machine.overflowed = false
 
 	// create graphics
-	err = machine.Store(OUT_MODE, OUT_MODE_TERM)
+	err = machine.Memory.Store(machine.layout.mode(), OUT_MODE_TERM)
 	if err != nil {
 		return err
 	}
-	pointer := OUT_COLORS
+	pointer := machine.layout.colors()
 	for _, color := range BaseColors {
-		err = machine.Store(pointer, color)
+		err = machine.Memory.Store(pointer, color)
 		if err != nil {
 			return err
 		}
 		pointer += 2
 	}
 
-	machine.keepRunning = true
 	return nil
 }
 
 // String visualizes the register segment of the virtual machine.
-func (machine Machine) String() string {
-	return machine.dumpSegment(0)
-}
-
-// dumpSegment creates a hex dump of a memory segment.
-func (machine *Machine) dumpSegment(seg int) string {
-	start := uint16(seg * 256)
-	dump := fmt.Sprintf("SEGMENT %4.4X - %4.4X\n-------------------", start, start+0xFF)
-	for i := start; i <= start+0xFF; i += WORD_SIZE {
-		if i%16 == 0 {
-			dump += "\n"
-		}
-		word, err := machine.Load(i)
-		if err != nil {
-			dump += "err"
-			return dump
-		}
-		dump += fmt.Sprintf("%-5.4X", word)
-	}
-	return dump
+func (machine *Machine) String() string {
+	return machine.Dump(0, PAGE_SIZE-1)
 }
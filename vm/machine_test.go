@@ -0,0 +1,281 @@
+package vm
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// nullDisplay discards all output of headless machines.
+type nullDisplay struct{}
+
+func (nullDisplay) Draw(width, height int, data []byte) {}
+func (nullDisplay) Init() error                         { return nil }
+func (nullDisplay) Close()                              {}
+
+// newHeadless creates a machine without a terminal display.
+func newHeadless(opts ...Option) *Machine {
+	machine := New(opts...)
+	machine.SetDisplay(nullDisplay{})
+	return machine
+}
+
+// bytecode encodes raw words as a program.
+func bytecode(words ...uint16) []byte {
+	code := make([]byte, len(words)*int(WORD_SIZE))
+	for i, word := range words {
+		ByteOrder.PutUint16(code[i*int(WORD_SIZE):], word)
+	}
+	return code
+}
+
+// load initializes a machine and places raw words at the code base.
+func load(t testing.TB, machine *Machine, words ...uint16) {
+	if err := machine.initialize(); err != nil {
+		t.Fatal(err)
+	}
+	place(t, machine, CODE_BASE, words...)
+	if err := machine.Memory.Store(CODE_POINTER, CODE_BASE); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// place stores raw words at a physical address.
+func place(t testing.TB, machine *Machine, addr uint16, words ...uint16) {
+	for i, word := range words {
+		if err := machine.Memory.Store(addr+uint16(i)*WORD_SIZE, word); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPowerOff(t *testing.T) {
+	// MOV handler IR_STATE; BRK; loop: JMP loop; HLT; handler
+	for _, c := range []struct {
+		name    string
+		handler []uint16
+		grace   time.Duration
+		ax, bx  uint16
+	}{
+		{"no handler", nil, time.Hour, 0, 0},
+		// handler: INC AX; loop: JMP loop
+		{"grace period", []uint16{FLAG_R | CMD_INC, REGISTER_AX, FLAG_I | CMD_JMP, CODE_BASE + 18}, 20 * time.Millisecond, 1, 0},
+		// handler: MOV INTERRUPT BX; HLT
+		{"handler halts", []uint16{FLAG_RR | CMD_MOV, INTERRUPT, REGISTER_BX, CMD_HLT}, time.Hour, 0, IR_STATE_POWER_OFF},
+	} {
+		var vector uint16
+		if c.handler != nil {
+			vector = CODE_BASE + 14
+		}
+		program := append([]uint16{
+			FLAG_IR | CMD_MOV, vector, IR_STATE,
+			CMD_BRK,
+			FLAG_I | CMD_JMP, CODE_BASE + 8,
+			CMD_HLT,
+		}, c.handler...)
+		machine := newHeadless()
+		machine.SetBreakHandler(func(machine *Machine) bool {
+			machine.PowerOff(c.grace)
+			return true
+		})
+		start := time.Now()
+		if err := machine.Boot(bytecode(program...)); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second || elapsed < c.grace && c.grace < time.Second {
+			t.Errorf("%s: halted after %v", c.name, elapsed)
+		}
+		ax, _ := machine.Load(REGISTER_AX)
+		bx, _ := machine.Load(REGISTER_BX)
+		if ax != c.ax || bx != c.bx {
+			t.Errorf("%s: AX = %d, BX = %d, want %d, %d", c.name, ax, bx, c.ax, c.bx)
+		}
+	}
+}
+
+func TestHaltBeforeBoot(t *testing.T) {
+	machine := newHeadless()
+	machine.PowerOff(time.Hour)
+	// INC AX; HLT
+	program := bytecode(FLAG_R|CMD_INC, REGISTER_AX, CMD_HLT)
+	if err := machine.Boot(program); err != nil {
+		t.Fatal(err)
+	}
+	if ax, _ := machine.Load(REGISTER_AX); ax != 0 {
+		t.Errorf("AX = %d, machine ran after an early power-off", ax)
+	}
+	if err := machine.Boot(program); err != nil {
+		t.Fatal(err)
+	}
+	if ax, _ := machine.Load(REGISTER_AX); ax != 1 {
+		t.Errorf("AX = %d, second boot did not run", ax)
+	}
+}
+
+func TestRepeatedPowerOff(t *testing.T) {
+	// MOV handler IR_STATE; BRK; loop: JMP loop; handler: JMP handler
+	machine := newHeadless()
+	machine.SetBreakHandler(func(machine *Machine) bool {
+		machine.PowerOff(time.Hour)
+		machine.PowerOff(time.Hour)
+		return true
+	})
+	start := time.Now()
+	err := machine.Boot(bytecode(
+		FLAG_IR|CMD_MOV, CODE_BASE+12, IR_STATE,
+		CMD_BRK,
+		FLAG_I|CMD_JMP, CODE_BASE+8,
+		FLAG_I|CMD_JMP, CODE_BASE+12))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("halted after %v", elapsed)
+	}
+}
+
+func TestPowerOffWhileProtecting(t *testing.T) {
+	machine := newHeadless()
+	machine.Protect(CODE_BASE, CODE_BASE, PERM_ALL)
+	// MOV 0x3000 AX; loop: PROT AX 7; SPT 0; JMP loop
+	load(t, machine,
+		FLAG_IR|CMD_MOV, 0x3000, REGISTER_AX,
+		FLAG_RI|CMD_PROT, REGISTER_AX, 7,
+		FLAG_I|CMD_SPT, 0,
+		FLAG_I|CMD_JMP, CODE_BASE+6)
+	done := make(chan error)
+	go func() {
+		done <- machine.run()
+	}()
+	time.Sleep(10 * time.Millisecond)
+	machine.PowerOff(time.Second)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// brokenDisplay fails to initialize.
+type brokenDisplay struct{ nullDisplay }
+
+func (brokenDisplay) Init() error { return errors.New("no terminal") }
+
+func TestDisplayInitError(t *testing.T) {
+	machine := newHeadless()
+	machine.SetDisplay(brokenDisplay{})
+	program := bytecode(FLAG_R|CMD_INC, REGISTER_AX, CMD_HLT)
+	if err := machine.Boot(program); err == nil {
+		t.Error("Boot ignored the display error")
+	}
+	if err := machine.Resume(); err == nil {
+		t.Error("Resume ignored the display error")
+	}
+	if value, _ := machine.Load(REGISTER_AX); value != 0 {
+		t.Errorf("program ran without a display, AX = %d", value)
+	}
+}
+
+// shadowRegisters maps a device forwarding to the register file over it,
+// forcing all register accesses through the bus.
+type shadowRegisters struct {
+	*registerFile
+}
+
+func TestShadowedRegisters(t *testing.T) {
+	machine := newHeadless()
+	if !machine.direct(REGISTER_AX) {
+		t.Fatal("register file not accessed directly")
+	}
+	machine.Bus().Map(REGISTER_AX, REGISTER_AX+1, NewROM([]byte{0x12, 0x34}))
+	if machine.direct(REGISTER_AX) {
+		t.Fatal("direct access to shadowed registers")
+	}
+	value, err := machine.Load(REGISTER_AX)
+	if err != nil || value != 0x1234 {
+		t.Errorf("Load(AX) = %04X, %v", value, err)
+	}
+}
+
+func TestStraddlingRegisters(t *testing.T) {
+	machine := newHeadless()
+	if err := machine.Store(IR_OVERFLOW, 0x1234); err != nil {
+		t.Fatal(err)
+	}
+	if err := machine.Store(IR_TIMER, 0x5678); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := machine.Load(REGISTER_FILE_END - 1); err != nil || value != 0x3456 {
+		t.Errorf("Load(%04X) = %04X, %v, want 3456", REGISTER_FILE_END-1, value, err)
+	}
+	if err := machine.Store(REGISTER_FILE_END-1, 0xABCD); err != nil {
+		t.Fatal(err)
+	}
+	overflow, _ := machine.Load(IR_OVERFLOW)
+	timer, _ := machine.Load(IR_TIMER)
+	if overflow != 0x12AB || timer != 0xCD78 {
+		t.Errorf("IR_OVERFLOW = %04X, IR_TIMER = %04X, want 12AB, CD78", overflow, timer)
+	}
+	// the control registers end in front of BANK_SELECT
+	machine.Store(TIMER_TICKS, 0x1234)
+	machine.Store(CONTROL_FILE_END, 0x5678)
+	if value, err := machine.Load(CONTROL_FILE_END - 1); err != nil || value != 0x3456 {
+		t.Errorf("Load(%04X) = %04X, %v, want 3456", CONTROL_FILE_END-1, value, err)
+	}
+}
+
+func BenchmarkStep(b *testing.B) {
+	// loop: INC AX; MOV AX BX; CMP BX 7; PUSH AX; POP CX; JMP loop
+	code := []uint16{
+		FLAG_R | CMD_INC, REGISTER_AX,
+		FLAG_RR | CMD_MOV, REGISTER_AX, REGISTER_BX,
+		FLAG_RI | CMD_CMP, REGISTER_BX, 7,
+		FLAG_R | CMD_PUSH, REGISTER_AX,
+		FLAG_R | CMD_POP, REGISTER_CX,
+		FLAG_I | CMD_JMP, CODE_BASE,
+	}
+	for _, path := range []string{"direct", "bus"} {
+		b.Run(path, func(b *testing.B) {
+			machine := newHeadless()
+			if path == "bus" {
+				machine.Bus().Map(CODE_POINTER, REGISTER_FILE_END-1, shadowRegisters{&machine.registers})
+			}
+			load(b, machine, code...)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := machine.step(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkRun(b *testing.B) {
+	// loop: INC AX; MOV AX BX; PUSH AX; POP BX; DEC CX; MOV CX DX; CMP DX 0; JIF loop; HLT
+	code := []uint16{
+		FLAG_R | CMD_INC, REGISTER_AX,
+		FLAG_RR | CMD_MOV, REGISTER_AX, REGISTER_BX,
+		FLAG_R | CMD_PUSH, REGISTER_AX,
+		FLAG_R | CMD_POP, REGISTER_BX,
+		FLAG_R | CMD_DEC, REGISTER_CX,
+		FLAG_RR | CMD_MOV, REGISTER_CX, REGISTER_DX,
+		FLAG_RI | CMD_CMP, REGISTER_DX, 0,
+		FLAG_I | CMD_JIF, CODE_BASE,
+		CMD_HLT,
+	}
+	machine := newHeadless()
+	load(b, machine, code...)
+	b.ResetTimer()
+	// each run executes up to 0xFFFF iterations of 8 commands, counted in CX
+	for left := b.N; left > 0; left -= 0xFFFF {
+		iterations := left
+		if iterations > 0xFFFF {
+			iterations = 0xFFFF
+		}
+		machine.Memory.Store(REGISTER_CX, uint16(iterations))
+		machine.Memory.Store(CODE_POINTER, CODE_BASE)
+		machine.keepRunning = 1
+		if err := machine.run(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package vm
 import (
 	"encoding/binary"
 	"fmt"
+	"sync"
 )
 
 // Memory is a virtual representation of a RAM.
@@ -15,6 +16,15 @@ type Memory interface {
 	InRange(addr uint16) bool
 }
 
+// AtomicMemory is a memory supporting atomic read-modify-write operations.
+type AtomicMemory interface {
+	Memory
+	// Swap stores a word and returns the previous word.
+	Swap(addr, value uint16) (uint16, error)
+	// CompareAndSwap stores a word if the current word equals old and returns the current word.
+	CompareAndSwap(addr, old, value uint16) (bool, uint16, error)
+}
+
 // OutOfRangeError is thrown if a address is out of memory range.
 type OutOfRangeError struct {
 	Address uint16
@@ -34,7 +44,7 @@ func (memory randomAccessMemory) InRange(addr uint16) bool {
 
 // Load fetches a word from memory.
 func (memory randomAccessMemory) Load(addr uint16) (uint16, error) {
-	if !memory.InRange(addr) {
+	if int(addr)+1 >= len(memory) {
 		return 0, &OutOfRangeError{addr}
 	}
 	return binary.BigEndian.Uint16(memory[addr : addr+2]), nil
@@ -42,7 +52,7 @@ func (memory randomAccessMemory) Load(addr uint16) (uint16, error) {
 
 // Store puts a word into memory.
 func (memory randomAccessMemory) Store(addr, value uint16) error {
-	if !memory.InRange(addr) {
+	if int(addr)+1 >= len(memory) {
 		return &OutOfRangeError{addr}
 	}
 	binary.BigEndian.PutUint16(memory[addr:addr+2], value)
@@ -75,3 +85,94 @@ func NewMemory(size int) Memory {
 	instance := make(randomAccessMemory, size)
 	return &instance
 }
+
+// SyncMemory guards a memory against concurrent access from multiple goroutines.
+type SyncMemory struct {
+	mutex  sync.Mutex
+	memory Memory
+}
+
+// InRange checks if the given address is in memory range.
+func (memory *SyncMemory) InRange(addr uint16) bool {
+	return memory.memory.InRange(addr)
+}
+
+// Load fetches a word from memory.
+func (memory *SyncMemory) Load(addr uint16) (uint16, error) {
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+	return memory.memory.Load(addr)
+}
+
+// Store puts a word into memory.
+func (memory *SyncMemory) Store(addr, value uint16) error {
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+	return memory.memory.Store(addr, value)
+}
+
+// StoreByte puts a byte into memory.
+func (memory *SyncMemory) StoreByte(addr uint16, value byte) error {
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+	return memory.memory.StoreByte(addr, value)
+}
+
+// SwapByte stores a byte and returns the previous byte.
+func (memory *SyncMemory) SwapByte(addr uint16, value byte) (byte, error) {
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+	old := loadByte(memory.memory, addr)
+	return old, memory.memory.StoreByte(addr, value)
+}
+
+// Segment returns a copy of a memory segment.
+func (memory *SyncMemory) Segment(from, to uint16) []byte {
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+	return append([]byte(nil), memory.memory.Segment(from, to)...)
+}
+
+// Convert converts a word into a slice of bytes.
+func (memory *SyncMemory) Convert(value uint16) []byte {
+	return memory.memory.Convert(value)
+}
+
+// Swap stores a word and returns the previous word.
+func (memory *SyncMemory) Swap(addr, value uint16) (uint16, error) {
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+	old, err := memory.memory.Load(addr)
+	if err != nil {
+		return 0, err
+	}
+	return old, memory.memory.Store(addr, value)
+}
+
+// CompareAndSwap stores a word if the current word equals old and returns the current word.
+func (memory *SyncMemory) CompareAndSwap(addr, old, value uint16) (bool, uint16, error) {
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+	current, err := memory.memory.Load(addr)
+	if err != nil {
+		return false, 0, err
+	}
+	if current != old {
+		return false, current, nil
+	}
+	return true, current, memory.memory.Store(addr, value)
+}
+
+// NewSyncMemory wraps a memory to be safe for concurrent use.
+func NewSyncMemory(memory Memory) *SyncMemory {
+	return &SyncMemory{memory: memory}
+}
+
+// loadByte reads the byte at an address, which may be the last address of the memory.
+func loadByte(memory Memory, addr uint16) byte {
+	if word, err := memory.Load(addr); err == nil {
+		return byte(word >> 8)
+	}
+	word, _ := memory.Load(addr - 1)
+	return byte(word)
+}
@@ -0,0 +1,265 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrChecksum is returned if a persisted NVRAM file is corrupted.
+var ErrChecksum = errors.New("nvram checksum mismatch")
+
+// NVRAM is a battery-backed memory persisted to a host file.
+// The file holds the memory contents followed by their CRC-32 checksum.
+type NVRAM struct {
+	mutex    sync.Mutex
+	path     string
+	data     []byte
+	status   uint16
+	modified bool
+	// serializes writing the file, which happens without holding mutex
+	flushing sync.Mutex
+	// set by the control register, see flushRequested
+	requested int32
+}
+
+// NewNVRAM creates a non-volatile memory of the given size persisted to path.
+func NewNVRAM(path string, size int) *NVRAM {
+	return &NVRAM{path: path, data: make([]byte, size)}
+}
+
+// Size returns the size of the memory in bytes.
+func (nvram *NVRAM) Size() int {
+	return len(nvram.data)
+}
+
+// Status returns the NVRAM_* status bits.
+func (nvram *NVRAM) Status() uint16 {
+	nvram.mutex.Lock()
+	defer nvram.mutex.Unlock()
+	return nvram.status
+}
+
+// Modified checks if the memory has been written since it was restored or flushed.
+func (nvram *NVRAM) Modified() bool {
+	nvram.mutex.Lock()
+	defer nvram.mutex.Unlock()
+	return nvram.modified
+}
+
+// Restore loads the memory from its file. A missing file leaves the memory cleared,
+// a corrupted file is moved aside for recovery (see keepCorrupt), clears the memory and returns ErrChecksum.
+func (nvram *NVRAM) Restore() error {
+	nvram.mutex.Lock()
+	defer nvram.mutex.Unlock()
+	for i := range nvram.data {
+		nvram.data[i] = 0
+	}
+	nvram.status = 0
+	nvram.modified = false
+	file, err := ioutil.ReadFile(nvram.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	size := len(nvram.data)
+	if len(file) != size+4 || crc32.ChecksumIEEE(file[:size]) != ByteOrder.Uint32(file[size:]) {
+		nvram.status = NVRAM_CORRUPT
+		err = keepCorrupt(nvram.path)
+		if err != nil {
+			return err
+		}
+		return ErrChecksum
+	}
+	copy(nvram.data, file)
+	nvram.status = NVRAM_VALID
+	return nil
+}
+
+// keepCorrupt moves a corrupted file to path.corrupt without replacing files kept earlier,
+// falling back to path.corrupt.1, path.corrupt.2 and so on.
+func keepCorrupt(path string) error {
+	target := path + ".corrupt"
+	for i := 1; ; i++ {
+		_, err := os.Lstat(target)
+		if os.IsNotExist(err) {
+			return os.Rename(path, target)
+		}
+		if err != nil {
+			return err
+		}
+		target = fmt.Sprintf("%s.corrupt.%d", path, i)
+	}
+}
+
+// Flush writes the memory and its checksum to the file.
+// The memory is copied first, so accesses are not blocked while the file is written.
+// Copies held by forked machines have no file and are never written.
+func (nvram *NVRAM) Flush() error {
+	nvram.flushing.Lock()
+	defer nvram.flushing.Unlock()
+	nvram.mutex.Lock()
+	file := make([]byte, len(nvram.data)+4)
+	copy(file, nvram.data)
+	nvram.modified = false
+	nvram.mutex.Unlock()
+	if nvram.path == "" {
+		return nil
+	}
+	size := len(file) - 4
+	ByteOrder.PutUint32(file[size:], crc32.ChecksumIEEE(file[:size]))
+	// Replace the file at once, so an interrupted flush keeps the previous contents
+	err := writeSynced(nvram.path+".tmp", file)
+	if err == nil {
+		err = os.Rename(nvram.path+".tmp", nvram.path)
+	}
+	nvram.mutex.Lock()
+	defer nvram.mutex.Unlock()
+	if err != nil {
+		nvram.status |= NVRAM_ERROR
+		nvram.modified = true
+		return err
+	}
+	nvram.status &^= NVRAM_ERROR
+	return nil
+}
+
+// writeSynced writes the file and waits until it reached the disk.
+func writeSynced(path string, data []byte) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// flushRequested flushes the memory if the program requested it through the control register.
+// The control register runs while the memory of the machine is locked, so it only records the request.
+func (nvram *NVRAM) flushRequested() {
+	if atomic.CompareAndSwapInt32(&nvram.requested, 1, 0) {
+		nvram.Flush()
+	}
+}
+
+// fork copies the memory for a forked machine. The copy is not persisted,
+// so only the original NVRAM writes the file.
+func (nvram *NVRAM) fork() *NVRAM {
+	nvram.mutex.Lock()
+	defer nvram.mutex.Unlock()
+	return &NVRAM{
+		data:     append([]byte(nil), nvram.data...),
+		status:   nvram.status,
+		modified: nvram.modified,
+	}
+}
+
+// Load fetches a word from the memory.
+func (nvram *NVRAM) Load(offset uint16) (uint16, error) {
+	nvram.mutex.Lock()
+	defer nvram.mutex.Unlock()
+	if int(offset)+1 >= len(nvram.data) {
+		return 0, &OutOfRangeError{offset}
+	}
+	return ByteOrder.Uint16(nvram.data[offset:]), nil
+}
+
+// Store puts a word into the memory.
+func (nvram *NVRAM) Store(offset, value uint16) error {
+	nvram.mutex.Lock()
+	defer nvram.mutex.Unlock()
+	if int(offset)+1 >= len(nvram.data) {
+		return &OutOfRangeError{offset}
+	}
+	ByteOrder.PutUint16(nvram.data[offset:], value)
+	nvram.modified = true
+	return nil
+}
+
+// StoreByte puts a byte into the memory.
+func (nvram *NVRAM) StoreByte(offset uint16, value byte) error {
+	nvram.mutex.Lock()
+	defer nvram.mutex.Unlock()
+	if int(offset) >= len(nvram.data) {
+		return &OutOfRangeError{offset}
+	}
+	nvram.data[offset] = value
+	nvram.modified = true
+	return nil
+}
+
+// nvramControl is the control register of an NVRAM.
+// Reading returns the status, writing NVRAM_FLUSH flushes the memory to its file once the command completed.
+type nvramControl struct {
+	nvram *NVRAM
+}
+
+// Load returns the status of the NVRAM.
+func (reg nvramControl) Load(offset uint16) (uint16, error) {
+	return reg.nvram.Status(), nil
+}
+
+// Store executes a control command.
+// Failed flushes only set NVRAM_ERROR in the status, the program decides how to react.
+func (reg nvramControl) Store(offset, value uint16) error {
+	if value&NVRAM_FLUSH != 0 {
+		atomic.StoreInt32(&reg.nvram.requested, 1)
+	}
+	return nil
+}
+
+// StoreByte executes a control command given by the low byte.
+func (reg nvramControl) StoreByte(offset uint16, value byte) error {
+	if offset == 1 {
+		return reg.Store(offset, uint16(value))
+	}
+	return nil
+}
+
+// AttachNVRAM maps an NVRAM at the given address and its control register onto the bus.
+// The NVRAM is restored when the machine boots and flushed when it stops.
+// Empty NVRAMs and NVRAMs exceeding the address space are rejected.
+func (machine *Machine) AttachNVRAM(nvram *NVRAM, first uint16) error {
+	if size := nvram.Size(); size == 0 || int(first)+size > int(MAX_MEMORY)+1 {
+		return fmt.Errorf("nvram of %d bytes does not fit at %4.4X", size, first)
+	}
+	machine.bus.Map(first, first+uint16(nvram.Size()-1), nvram)
+	machine.bus.Map(NVRAM_CONTROL, NVRAM_CONTROL+1, nvramControl{nvram})
+	machine.nvram = nvram
+	machine.nvramBase = first
+	machine.restored = false
+	return nil
+}
+
+// restoreNVRAM loads the attached NVRAM. Corrupted files are reported to the program in the status.
+func (machine *Machine) restoreNVRAM() error {
+	if machine.nvram == nil {
+		return nil
+	}
+	err := machine.nvram.Restore()
+	if err != nil && err != ErrChecksum {
+		return err
+	}
+	machine.restored = true
+	return nil
+}
+
+// flushNVRAM persists the attached NVRAM if the program has written to it since it was restored.
+func (machine *Machine) flushNVRAM() error {
+	if machine.nvram == nil || !machine.restored || !machine.nvram.Modified() {
+		return nil
+	}
+	return machine.nvram.Flush()
+}
@@ -0,0 +1,146 @@
+package vm
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNVRAMCorruptFileKept(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "save.nv")
+	corrupt := []byte("not an nvram image")
+	if err := ioutil.WriteFile(path, corrupt, 0644); err != nil {
+		t.Fatal(err)
+	}
+	machine := newHeadless()
+	nvram := NewNVRAM(path, int(NVRAM_SIZE))
+	if err := machine.AttachNVRAM(nvram, NVRAM_BASE); err != nil {
+		t.Fatal(err)
+	}
+	if err := machine.BootAt([]byte{0x00, byte(CMD_HLT)}, CODE_BASE); err != nil {
+		t.Fatal(err)
+	}
+	if nvram.Status() != NVRAM_CORRUPT {
+		t.Errorf("Status() = %d", nvram.Status())
+	}
+	kept, err := ioutil.ReadFile(path + ".corrupt")
+	if err != nil || string(kept) != string(corrupt) {
+		t.Errorf("corrupt file = %q, %v", kept, err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("unmodified NVRAM flushed: %v", err)
+	}
+}
+
+func TestNVRAMFlushError(t *testing.T) {
+	nvram := NewNVRAM(filepath.Join(t.TempDir(), "missing", "save.nv"), int(NVRAM_SIZE))
+	if err := (nvramControl{nvram}).Store(0, NVRAM_FLUSH); err != nil {
+		t.Errorf("failed flush aborts the program: %v", err)
+	}
+	// The control register runs under the memory lock and leaves the file to the machine
+	if nvram.Status()&NVRAM_ERROR != 0 {
+		t.Errorf("flushed inside the control register")
+	}
+	nvram.flushRequested()
+	if nvram.Status()&NVRAM_ERROR == 0 {
+		t.Errorf("Status() = %d", nvram.Status())
+	}
+}
+
+func TestNVRAMRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "save.nv")
+	machine := newHeadless()
+	if err := machine.AttachNVRAM(NewNVRAM(path, int(NVRAM_SIZE)), NVRAM_BASE); err != nil {
+		t.Fatal(err)
+	}
+	// MOV 0x1234 NVRAM_BASE; HLT
+	if err := machine.Boot(bytecode(FLAG_IR|CMD_MOV, 0x1234, NVRAM_BASE, CMD_HLT)); err != nil {
+		t.Fatal(err)
+	}
+
+	machine = newHeadless()
+	if err := machine.AttachNVRAM(NewNVRAM(path, int(NVRAM_SIZE)), NVRAM_BASE); err != nil {
+		t.Fatal(err)
+	}
+	// MOV NVRAM_BASE AX; MOV NVRAM_CONTROL BX; HLT
+	err := machine.Boot(bytecode(
+		FLAG_RR|CMD_MOV, NVRAM_BASE, REGISTER_AX,
+		FLAG_RR|CMD_MOV, NVRAM_CONTROL, REGISTER_BX,
+		CMD_HLT))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ax, _ := machine.Load(REGISTER_AX)
+	bx, _ := machine.Load(REGISTER_BX)
+	if ax != 0x1234 || bx != NVRAM_VALID {
+		t.Errorf("AX = %04X, BX = %d, want 1234, %d", ax, bx, NVRAM_VALID)
+	}
+}
+
+func TestNVRAMFlushCommand(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "save.nv")
+	nvram := NewNVRAM(path, int(NVRAM_SIZE))
+	machine := newHeadless()
+	if err := machine.AttachNVRAM(nvram, NVRAM_BASE); err != nil {
+		t.Fatal(err)
+	}
+	var flushed []byte
+	machine.SetBreakHandler(func(machine *Machine) bool {
+		flushed, _ = ioutil.ReadFile(path)
+		return false
+	})
+	// MOV 0x5678 NVRAM_BASE; MOV NVRAM_FLUSH NVRAM_CONTROL; BRK
+	err := machine.Boot(bytecode(
+		FLAG_IR|CMD_MOV, 0x5678, NVRAM_BASE,
+		FLAG_IR|CMD_MOV, NVRAM_FLUSH, NVRAM_CONTROL,
+		CMD_BRK))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(flushed) != int(NVRAM_SIZE)+4 || flushed[0] != 0x56 || flushed[1] != 0x78 {
+		t.Errorf("file after NC flush holds %d bytes, want %d starting with 5678", len(flushed), NVRAM_SIZE+4)
+	}
+	if nvram.Modified() {
+		t.Error("NVRAM modified after flush")
+	}
+}
+
+func TestNVRAMCorruptFilesNotReplaced(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "save.nv")
+	for _, name := range []string{path + ".corrupt", path} {
+		if err := ioutil.WriteFile(name, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := NewNVRAM(path, int(NVRAM_SIZE)).Restore(); err != ErrChecksum {
+		t.Fatalf("Restore() = %v, want %v", err, ErrChecksum)
+	}
+	for name, want := range map[string]string{path + ".corrupt": path + ".corrupt", path + ".corrupt.1": path} {
+		kept, err := ioutil.ReadFile(name)
+		if err != nil || string(kept) != want {
+			t.Errorf("%s = %q, %v, want %q", name, kept, err, want)
+		}
+	}
+}
+
+func TestAttachNVRAMRange(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "save.nv")
+	cases := []struct {
+		size  int
+		first uint16
+		ok    bool
+	}{
+		{0, NVRAM_BASE, false},
+		{0x100, 0xFF00, true},
+		{0x100, 0xFF01, false},
+		{0x10000, 0x0000, true},
+		{0x10001, 0x0000, false},
+	}
+	for _, c := range cases {
+		err := newHeadless().AttachNVRAM(NewNVRAM(path, c.size), c.first)
+		if (err == nil) != c.ok {
+			t.Errorf("AttachNVRAM(%d bytes, %04X) = %v", c.size, c.first, err)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package vm
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrObserveRunning is returned when observers are added to or removed from a running machine.
+var ErrObserveRunning = errors.New("cannot change the observers of a running machine")
+
+// MemoryAccess describes a single observed memory access.
+type MemoryAccess struct {
+	// PERM_READ for loads, PERM_WRITE for stores, PERM_EXECUTE for command fetches
+	Access  Permission
+	Address uint16
+	// Value loaded or stored, a single byte for byte stores
+	Value uint16
+	// Value before a store, equal to Value for loads
+	Old uint16
+	// Start of the command causing the access
+	PC   uint16
+	Byte bool
+}
+
+// Observer is notified about memory accesses.
+type Observer func(access MemoryAccess)
+
+// observerEntry is an observer filtered by an address range.
+type observerEntry struct {
+	id          int
+	first, last uint16
+	notify      Observer
+}
+
+// matches checks if the observed range overlaps the accessed bytes.
+func (entry observerEntry) matches(addr uint16, size int) bool {
+	return int(addr) <= int(entry.last) && int(addr)+size-1 >= int(entry.first)
+}
+
+// ObservedMemory wraps a memory and notifies observers about every access in their address range.
+// Observers are called synchronously after the access and may access the memory themselves.
+type ObservedMemory struct {
+	Memory
+	pc        func() uint16
+	mutex     sync.RWMutex
+	observers []observerEntry
+	nextID    int
+}
+
+// NewObservedMemory wraps a memory, using pc to determine the current code pointer for notifications.
+func NewObservedMemory(memory Memory, pc func() uint16) *ObservedMemory {
+	return &ObservedMemory{Memory: memory, pc: pc}
+}
+
+// Observe notifies the observer about accesses to the addresses from first to last (inclusive)
+// and returns a function removing the observer.
+func (memory *ObservedMemory) Observe(first, last uint16, observer Observer) func() {
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+	id := memory.nextID
+	memory.nextID++
+	memory.observers = append(memory.observers, observerEntry{id, first, last, observer})
+	return func() {
+		memory.mutex.Lock()
+		defer memory.mutex.Unlock()
+		observers := make([]observerEntry, 0, len(memory.observers))
+		for _, entry := range memory.observers {
+			if entry.id != id {
+				observers = append(observers, entry)
+			}
+		}
+		memory.observers = observers
+	}
+}
+
+// matching returns the observers interested in an access.
+func (memory *ObservedMemory) matching(addr uint16, size int) []Observer {
+	memory.mutex.RLock()
+	defer memory.mutex.RUnlock()
+	var observers []Observer
+	for _, entry := range memory.observers {
+		if entry.matches(addr, size) {
+			observers = append(observers, entry.notify)
+		}
+	}
+	return observers
+}
+
+// notify calls all observers with the access.
+func (memory *ObservedMemory) notify(observers []Observer, access MemoryAccess) {
+	if memory.pc != nil {
+		access.PC = memory.pc()
+	}
+	for _, observer := range observers {
+		observer(access)
+	}
+}
+
+// fetcher is a memory telling command fetches apart from data loads, such as ObservedMemory.
+type fetcher interface {
+	Fetch(addr uint16) (uint16, error)
+}
+
+// loadPhysical fetches a word for a read or execute access.
+func loadPhysical(memory Memory, addr uint16, access Permission) (uint16, error) {
+	if fetcher, ok := memory.(fetcher); ok && access == PERM_EXECUTE {
+		return fetcher.Fetch(addr)
+	}
+	return memory.Load(addr)
+}
+
+// byteSwapper is a memory able to swap single bytes atomically, such as SyncMemory.
+type byteSwapper interface {
+	SwapByte(addr uint16, value byte) (byte, error)
+}
+
+// Load fetches a word from memory.
+func (memory *ObservedMemory) Load(addr uint16) (uint16, error) {
+	return memory.load(addr, PERM_READ)
+}
+
+// Fetch loads a command word from memory, which observers see as PERM_EXECUTE access.
+func (memory *ObservedMemory) Fetch(addr uint16) (uint16, error) {
+	return memory.load(addr, PERM_EXECUTE)
+}
+
+// load fetches a word and notifies the observers about the access.
+func (memory *ObservedMemory) load(addr uint16, access Permission) (uint16, error) {
+	value, err := memory.Memory.Load(addr)
+	if err != nil {
+		return value, err
+	}
+	if observers := memory.matching(addr, 2); observers != nil {
+		memory.notify(observers, MemoryAccess{Access: access, Address: addr, Value: value, Old: value})
+	}
+	return value, nil
+}
+
+// Store puts a word into memory.
+func (memory *ObservedMemory) Store(addr, value uint16) error {
+	observers := memory.matching(addr, 2)
+	if observers == nil {
+		return memory.Memory.Store(addr, value)
+	}
+	var old uint16
+	var err error
+	if atomic, ok := memory.Memory.(AtomicMemory); ok {
+		old, err = atomic.Swap(addr, value)
+	} else {
+		old, _ = memory.Memory.Load(addr)
+		err = memory.Memory.Store(addr, value)
+	}
+	if err != nil {
+		return err
+	}
+	memory.notify(observers, MemoryAccess{Access: PERM_WRITE, Address: addr, Value: value, Old: old})
+	return nil
+}
+
+// StoreByte puts a byte into memory.
+func (memory *ObservedMemory) StoreByte(addr uint16, value byte) error {
+	observers := memory.matching(addr, 1)
+	if observers == nil {
+		return memory.Memory.StoreByte(addr, value)
+	}
+	var old byte
+	var err error
+	if swapper, ok := memory.Memory.(byteSwapper); ok {
+		old, err = swapper.SwapByte(addr, value)
+	} else {
+		old = loadByte(memory.Memory, addr)
+		err = memory.Memory.StoreByte(addr, value)
+	}
+	if err != nil {
+		return err
+	}
+	memory.notify(observers, MemoryAccess{Access: PERM_WRITE, Address: addr, Value: uint16(value), Old: uint16(old), Byte: true})
+	return nil
+}
+
+// Swap stores a word and returns the previous word, atomically if the wrapped memory supports it.
+func (memory *ObservedMemory) Swap(addr, value uint16) (uint16, error) {
+	var old uint16
+	var err error
+	if atomic, ok := memory.Memory.(AtomicMemory); ok {
+		old, err = atomic.Swap(addr, value)
+	} else {
+		old, err = memory.Memory.Load(addr)
+		if err == nil {
+			err = memory.Memory.Store(addr, value)
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	if observers := memory.matching(addr, 2); observers != nil {
+		memory.notify(observers, MemoryAccess{Access: PERM_READ | PERM_WRITE, Address: addr, Value: value, Old: old})
+	}
+	return old, nil
+}
+
+// CompareAndSwap stores a word if the current word equals old and returns the current word,
+// atomically if the wrapped memory supports it.
+func (memory *ObservedMemory) CompareAndSwap(addr, old, value uint16) (bool, uint16, error) {
+	var swapped bool
+	var current uint16
+	var err error
+	if atomic, ok := memory.Memory.(AtomicMemory); ok {
+		swapped, current, err = atomic.CompareAndSwap(addr, old, value)
+	} else {
+		current, err = memory.Memory.Load(addr)
+		if err == nil && current == old {
+			swapped, err = true, memory.Memory.Store(addr, value)
+		}
+	}
+	if err != nil {
+		return false, 0, err
+	}
+	if observers := memory.matching(addr, 2); observers != nil {
+		access := MemoryAccess{Access: PERM_READ, Address: addr, Value: current, Old: current}
+		if swapped {
+			access = MemoryAccess{Access: PERM_READ | PERM_WRITE, Address: addr, Value: value, Old: current}
+		}
+		memory.notify(observers, access)
+	}
+	return swapped, current, nil
+}
+
+// Observe notifies the observer about all accesses of the machine to the physical addresses
+// from first to last (inclusive) and returns a function removing the observer.
+// Observers can only be added while the machine is not running, otherwise ErrObserveRunning is returned.
+func (machine *Machine) Observe(first, last uint16, observer Observer) (func(), error) {
+	machine.mutex.Lock()
+	defer machine.mutex.Unlock()
+	if machine.executing {
+		return nil, ErrObserveRunning
+	}
+	observed, ok := machine.Memory.(*ObservedMemory)
+	if !ok {
+		observed = NewObservedMemory(machine.Memory, func() uint16 { return machine.current })
+		machine.Memory = observed
+		machine.observed = true
+	}
+	return observed.Observe(first, last, observer), nil
+}
+
+// Unobserve removes all observers of the machine and restores the direct access to its memory.
+// Like Observe, it returns ErrObserveRunning while the machine is running.
+func (machine *Machine) Unobserve() error {
+	machine.mutex.Lock()
+	defer machine.mutex.Unlock()
+	if machine.executing {
+		return ErrObserveRunning
+	}
+	if observed, ok := machine.Memory.(*ObservedMemory); ok {
+		machine.Memory = observed.Memory
+	}
+	machine.observed = false
+	return nil
+}
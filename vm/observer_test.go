@@ -0,0 +1,131 @@
+package vm
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestObservedMemory(t *testing.T) {
+	// plain memories are read before the store, synchronized ones swapped atomically
+	for _, wrapped := range []Memory{NewMemory(int(MAX_MEMORY) + 1), NewSyncMemory(NewMemory(int(MAX_MEMORY) + 1))} {
+		memory := NewObservedMemory(wrapped, nil)
+		var accesses []MemoryAccess
+		remove := memory.Observe(0x100, 0x103, func(access MemoryAccess) {
+			accesses = append(accesses, access)
+		})
+		memory.Store(0x0FE, 1)
+		memory.Store(0x0FF, 0xAAAA)
+		memory.Store(0x102, 7)
+		memory.Load(0x102)
+		memory.StoreByte(0x103, 9)
+		memory.StoreByte(0x104, 9)
+		memory.Load(0x200)
+		remove()
+		memory.Store(0x102, 8)
+		want := []MemoryAccess{
+			{Access: PERM_WRITE, Address: 0x0FF, Value: 0xAAAA, Old: 0x0100},
+			{Access: PERM_WRITE, Address: 0x102, Value: 7},
+			{Access: PERM_READ, Address: 0x102, Value: 7, Old: 7},
+			{Access: PERM_WRITE, Address: 0x103, Value: 9, Old: 7, Byte: true},
+		}
+		if !reflect.DeepEqual(accesses, want) {
+			t.Errorf("%T: accesses = %+v, want %+v", wrapped, accesses, want)
+		}
+	}
+}
+
+func TestMachineObserver(t *testing.T) {
+	machine := newHeadless()
+	var accesses []MemoryAccess
+	_, err := machine.Observe(0x3000, 0x3001, func(access MemoryAccess) {
+		accesses = append(accesses, access)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// MOV 5 0x3000; MOV 0x3000 AX; HLT
+	err = machine.Boot(bytecode(
+		FLAG_IR|CMD_MOV, 5, 0x3000,
+		FLAG_RR|CMD_MOV, 0x3000, REGISTER_AX,
+		CMD_HLT))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []MemoryAccess{
+		{Access: PERM_WRITE, Address: 0x3000, Value: 5, PC: CODE_BASE},
+		{Access: PERM_READ, Address: 0x3000, Value: 5, Old: 5, PC: CODE_BASE + 6},
+	}
+	if !reflect.DeepEqual(accesses, want) {
+		t.Errorf("accesses = %+v, want %+v", accesses, want)
+	}
+}
+
+func TestObserveRunning(t *testing.T) {
+	machine := newHeadless()
+	var err error
+	machine.SetBreakHandler(func(machine *Machine) bool {
+		_, err = machine.Observe(0x3000, 0x3001, func(MemoryAccess) {})
+		return false
+	})
+	if bootErr := machine.Boot(bytecode(CMD_BRK)); bootErr != nil {
+		t.Fatal(bootErr)
+	}
+	if err != ErrObserveRunning {
+		t.Errorf("Observe() while running = %v, want %v", err, ErrObserveRunning)
+	}
+	if _, err := machine.Observe(0x3000, 0x3001, func(MemoryAccess) {}); err != nil {
+		t.Errorf("Observe() after halt = %v", err)
+	}
+}
+
+func TestObserveFetch(t *testing.T) {
+	machine := newHeadless()
+	var accesses []MemoryAccess
+	_, err := machine.Observe(CODE_BASE, CODE_BASE+1, func(access MemoryAccess) {
+		// skip loading the program
+		if access.Access != PERM_WRITE {
+			accesses = append(accesses, access)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// HLT
+	if err := machine.Boot(bytecode(CMD_HLT)); err != nil {
+		t.Fatal(err)
+	}
+	want := []MemoryAccess{{Access: PERM_EXECUTE, Address: CODE_BASE, Value: CMD_HLT, Old: CMD_HLT, PC: CODE_BASE}}
+	if !reflect.DeepEqual(accesses, want) {
+		t.Errorf("accesses = %+v, want %+v", accesses, want)
+	}
+}
+
+func TestUnobserve(t *testing.T) {
+	machine := newHeadless()
+	memory := machine.Memory
+	calls := 0
+	if _, err := machine.Observe(0x3000, 0x3001, func(MemoryAccess) { calls++ }); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	machine.SetBreakHandler(func(machine *Machine) bool {
+		err = machine.Unobserve()
+		return false
+	})
+	if bootErr := machine.Boot(bytecode(CMD_BRK)); bootErr != nil {
+		t.Fatal(bootErr)
+	}
+	if err != ErrObserveRunning {
+		t.Errorf("Unobserve() while running = %v, want %v", err, ErrObserveRunning)
+	}
+	if err := machine.Unobserve(); err != nil {
+		t.Fatal(err)
+	}
+	if machine.Memory != memory || !machine.direct(REGISTER_AX) {
+		t.Error("memory still observed")
+	}
+	machine.Store(0x3000, 1)
+	if calls != 0 {
+		t.Errorf("observer called %d times after Unobserve", calls)
+	}
+}
@@ -1,9 +1,146 @@
 package vm
 
+import (
+	"fmt"
+	"sync/atomic"
+)
+
 // Halt sets the running flag to false.
-// The machine will shutdown after the current operation.
+// The machine will shutdown after the current operation, a machine that has not booted yet
+// stops right after booting. It is safe to call from other goroutines.
 func (machine *Machine) Halt() {
-	machine.keepRunning = false
+	atomic.StoreInt32(&machine.keepRunning, 0)
+}
+
+// PerformBreak pauses the machine and hands control to the break handler.
+// Without a handler the machine state is printed in debug mode and execution continues.
+func (machine *Machine) PerformBreak() {
+	if machine.onBreak == nil {
+		if machine.debug {
+			fmt.Println(machine)
+		}
+		return
+	}
+	if !machine.onBreak(machine) {
+		machine.Halt()
+	}
+}
+
+// PerformIdentify stores the enabled feature set in AX and the instruction set version in BX.
+func (machine *Machine) PerformIdentify() error {
+	err := machine.Store(REGISTER_AX, uint16(machine.features))
+	if err != nil {
+		return err
+	}
+	err = machine.Store(REGISTER_BX, ISA_VERSION)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// exchangeTarget resolves the second operand of an exchange command, either a register (R,R)
+// or the memory word a register points to (R,A). Immediates cannot be exchanged.
+func (machine *Machine) exchangeTarget() (uint16, error) {
+	switch machine.flag {
+	case FLAG_RR:
+		return machine.args[1], nil
+	case FLAG_RA:
+		return machine.Load(machine.args[1])
+	}
+	return 0, fmt.Errorf("unsupported operands %4.4X for exchange", machine.flag)
+}
+
+// PerformExchange atomically swaps a register with a register or memory word.
+// Interrupts are only delivered between commands, so the exchange is never interrupted.
+// Registers held in native fields are swapped in place, other words through the AtomicMemory.
+func (machine *Machine) PerformExchange() error {
+	value, err := machine.Load(machine.args[0])
+	if err != nil {
+		return err
+	}
+	target, err := machine.exchangeTarget()
+	if err != nil {
+		return err
+	}
+	err = machine.protection.check(target, PERM_READ|PERM_WRITE)
+	if err != nil {
+		return err
+	}
+	physical, err := machine.paging.translate(machine.Memory, target, PERM_READ|PERM_WRITE)
+	if err != nil {
+		return err
+	}
+	var old uint16
+	if machine.native(physical) {
+		old = machine.registers.swap(physical, value)
+	} else if memory, ok := machine.Memory.(AtomicMemory); ok && !machine.paging.crossing(target) {
+		old, err = memory.Swap(physical, value)
+	} else {
+		old, err = machine.Load(target)
+		if err == nil {
+			err = machine.Store(target, value)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	err = machine.Store(machine.args[0], old)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// PerformCompareExchange atomically compares AX with a register or memory word and replaces it by a register if both are equal.
+// On success the zero flag is set, otherwise the zero flag is cleared and the memory word is loaded into AX.
+func (machine *Machine) PerformCompareExchange() error {
+	value, err := machine.Load(machine.args[0])
+	if err != nil {
+		return err
+	}
+	expected, err := machine.Load(REGISTER_AX)
+	if err != nil {
+		return err
+	}
+	target, err := machine.exchangeTarget()
+	if err != nil {
+		return err
+	}
+	err = machine.protection.check(target, PERM_READ|PERM_WRITE)
+	if err != nil {
+		return err
+	}
+	physical, err := machine.paging.translate(machine.Memory, target, PERM_READ|PERM_WRITE)
+	if err != nil {
+		return err
+	}
+	var swapped bool
+	var current uint16
+	if machine.native(physical) {
+		swapped, current = machine.registers.compareAndSwap(physical, expected, value)
+	} else if memory, ok := machine.Memory.(AtomicMemory); ok && !machine.paging.crossing(target) {
+		swapped, current, err = memory.CompareAndSwap(physical, expected, value)
+	} else {
+		current, err = machine.Load(target)
+		if err == nil && current == expected {
+			swapped, err = true, machine.Store(target, value)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	err = machine.storeRegister(ZERO_FLAG, toUint16(swapped))
+	if err != nil {
+		return err
+	}
+	if !swapped {
+		err = machine.Store(REGISTER_AX, current)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // PerformPush pushes an argument value onto the stack.
@@ -40,9 +177,14 @@ func (machine *Machine) PerformPop() error {
 }
 
 // PerformCall pushes the current code pointer onto the stack and jumps to the specified memory point.
+// PC-relative targets are offsets from the end of the call instruction.
 func (machine *Machine) PerformCall() error {
 	var value uint16
 	var err error
+	current, err := machine.loadRegister(CODE_POINTER)
+	if err != nil {
+		return err
+	}
 	switch machine.flag {
 	case FLAG_I:
 		value = machine.args[0]
@@ -51,16 +193,14 @@ func (machine *Machine) PerformCall() error {
 		if err != nil {
 			return err
 		}
-	}
-	current, err := machine.Load(CODE_POINTER)
-	if err != nil {
-		return err
+	case FLAG_P:
+		value = current + machine.args[0]
 	}
 	err = machine.push(current)
 	if err != nil {
 		return err
 	}
-	err = machine.Store(CODE_POINTER, value)
+	err = machine.storeRegister(CODE_POINTER, value)
 	if err != nil {
 		return err
 	}
@@ -73,13 +213,23 @@ func (machine *Machine) PerformReturn() error {
 	if err != nil {
 		return err
 	}
-	err = machine.Store(CODE_POINTER, value)
+	err = machine.storeRegister(CODE_POINTER, value)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// PerformInterruptReturn returns from an interrupt handler and ends the interrupt in service.
+func (machine *Machine) PerformInterruptReturn() error {
+	err := machine.PerformReturn()
+	if err != nil {
+		return err
+	}
+	machine.interrupts.complete()
+	return nil
+}
+
 // PerformSimpleArithmetic executes a simple arithmetic function with only one parameter.
 func (machine *Machine) PerformSimpleArithmetic(carry func(int) int) error {
 	var value1, result, zeroFlag, carryFlag uint16
@@ -93,7 +243,7 @@ func (machine *Machine) PerformSimpleArithmetic(carry func(int) int) error {
 	if result == 0 {
 		zeroFlag = 1
 	}
-	err = machine.Store(ZERO_FLAG, zeroFlag)
+	err = machine.storeRegister(ZERO_FLAG, zeroFlag)
 	if err != nil {
 		return err
 	}
@@ -101,7 +251,7 @@ func (machine *Machine) PerformSimpleArithmetic(carry func(int) int) error {
 	if int(result) != carryResult {
 		carryFlag = 1
 	}
-	err = machine.Store(CARRY_FLAG, carryFlag)
+	err = machine.storeRegister(CARRY_FLAG, carryFlag)
 	if err != nil {
 		return err
 	}
@@ -126,11 +276,11 @@ func (machine *Machine) PerformSimpleLogic(base func(uint16) uint16) error {
 		zeroFlag = 1
 	}
 
-	err = machine.Store(ZERO_FLAG, zeroFlag)
+	err = machine.storeRegister(ZERO_FLAG, zeroFlag)
 	if err != nil {
 		return err
 	}
-	err = machine.Store(CARRY_FLAG, 0)
+	err = machine.storeRegister(CARRY_FLAG, 0)
 	if err != nil {
 		return err
 	}
@@ -159,11 +309,11 @@ func (machine *Machine) PerformLogic(base func(uint16, uint16) uint16) error {
 	if result == 0 {
 		zeroFlag = 1
 	}
-	err = machine.Store(ZERO_FLAG, zeroFlag)
+	err = machine.storeRegister(ZERO_FLAG, zeroFlag)
 	if err != nil {
 		return err
 	}
-	err = machine.Store(CARRY_FLAG, 0)
+	err = machine.storeRegister(CARRY_FLAG, 0)
 	if err != nil {
 		return err
 	}
@@ -193,7 +343,7 @@ func (machine *Machine) PerformArithmetic(carry func(int, int) int) error {
 	if result == 0 {
 		zeroFlag = 1
 	}
-	err = machine.Store(ZERO_FLAG, zeroFlag)
+	err = machine.storeRegister(ZERO_FLAG, zeroFlag)
 	if err != nil {
 		return err
 	}
@@ -201,7 +351,7 @@ func (machine *Machine) PerformArithmetic(carry func(int, int) int) error {
 	if int(result) != carryResult {
 		carryFlag = 1
 	}
-	err = machine.Store(CARRY_FLAG, carryFlag)
+	err = machine.storeRegister(CARRY_FLAG, carryFlag)
 	if err != nil {
 		return err
 	}
@@ -215,6 +365,7 @@ func (machine *Machine) PerformArithmetic(carry func(int, int) int) error {
 // PerformJump jumps two the specified code point.
 // If JumpAlways is set to false,
 // the code pointer will only be changed if the zero flag is 1.
+// PC-relative targets are offsets from the end of the jump instruction.
 func (machine *Machine) PerformJump(jumpAlways bool) error {
 	var value uint16
 	var err error
@@ -226,13 +377,19 @@ func (machine *Machine) PerformJump(jumpAlways bool) error {
 		if err != nil {
 			return err
 		}
+	case FLAG_P:
+		current, err := machine.loadRegister(CODE_POINTER)
+		if err != nil {
+			return err
+		}
+		value = current + machine.args[0]
 	}
-	zeroFlag, err := machine.Load(ZERO_FLAG)
+	zeroFlag, err := machine.loadRegister(ZERO_FLAG)
 	if err != nil {
 		return err
 	}
 	if jumpAlways || zeroFlag == 1 {
-		err = machine.Store(CODE_POINTER, value)
+		err = machine.storeRegister(CODE_POINTER, value)
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,251 @@
+package vm
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestBreakHandler(t *testing.T) {
+	// BRK; INC AX; BRK; HLT
+	program := bytecode(CMD_BRK, FLAG_R|CMD_INC, REGISTER_AX, CMD_BRK, CMD_HLT)
+	for _, c := range []struct {
+		name    string
+		handler bool
+		resume  bool
+		breaks  []uint16
+		ax      uint16
+	}{
+		{"continue", true, true, []uint16{0, 1}, 1},
+		{"halt", true, false, []uint16{0}, 0},
+		{"no handler", false, false, nil, 1},
+	} {
+		machine := newHeadless()
+		var breaks []uint16
+		if c.handler {
+			resume := c.resume
+			machine.SetBreakHandler(func(machine *Machine) bool {
+				ax, _ := machine.Load(REGISTER_AX)
+				breaks = append(breaks, ax)
+				return resume
+			})
+		}
+		if err := machine.Boot(program); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		ax, _ := machine.Load(REGISTER_AX)
+		if !reflect.DeepEqual(breaks, c.breaks) || ax != c.ax {
+			t.Errorf("%s: breaks at AX %v, AX = %d, want %v, %d", c.name, breaks, ax, c.breaks, c.ax)
+		}
+	}
+}
+
+func TestRelativeBranches(t *testing.T) {
+	// CALL +6; INC BX; HLT; INC AX; MOV AX DX; CMP DX 3; JIF -20; RET
+	program := bytecode(
+		FLAG_P|CMD_CALL, 6,
+		FLAG_R|CMD_INC, REGISTER_BX,
+		CMD_HLT,
+		FLAG_R|CMD_INC, REGISTER_AX,
+		FLAG_RR|CMD_MOV, REGISTER_AX, REGISTER_DX,
+		FLAG_RI|CMD_CMP, REGISTER_DX, 3,
+		FLAG_P|CMD_JIF, 0xFFEC,
+		CMD_RET,
+	)
+	for _, base := range []uint16{CODE_BASE, 0x4000, 0x7FF0} {
+		machine := newHeadless()
+		if err := machine.BootAt(program, base); err != nil {
+			t.Fatalf("BootAt(%04X): %v", base, err)
+		}
+		ax, _ := machine.Load(REGISTER_AX)
+		bx, _ := machine.Load(REGISTER_BX)
+		if ax != 3 || bx != 1 {
+			t.Errorf("BootAt(%04X): AX = %d, BX = %d, want 3, 1", base, ax, bx)
+		}
+	}
+}
+
+func TestExchange(t *testing.T) {
+	// MOV 1 AX; MOV 2 BX; XCHG AX BX; MOV 0x3000 CX; MOV 5 DX; XCHG DX [CX]; HLT
+	program := bytecode(
+		FLAG_IR|CMD_MOV, 1, REGISTER_AX,
+		FLAG_IR|CMD_MOV, 2, REGISTER_BX,
+		FLAG_RR|CMD_XCHG, REGISTER_AX, REGISTER_BX,
+		FLAG_IR|CMD_MOV, 0x3000, REGISTER_CX,
+		FLAG_IR|CMD_MOV, 5, REGISTER_DX,
+		FLAG_RA|CMD_XCHG, REGISTER_DX, REGISTER_CX,
+		CMD_HLT,
+	)
+	machine := newHeadless()
+	if err := machine.Store(0x3000, 7); err != nil {
+		t.Fatal(err)
+	}
+	if err := machine.Boot(program); err != nil {
+		t.Fatal(err)
+	}
+	var got [4]uint16
+	for i, addr := range []uint16{REGISTER_AX, REGISTER_BX, REGISTER_DX, 0x3000} {
+		got[i], _ = machine.Load(addr)
+	}
+	if want := [4]uint16{2, 1, 7, 5}; got != want {
+		t.Errorf("AX, BX, DX, [3000] = %v, want %v", got, want)
+	}
+}
+
+func TestExchangeImmediate(t *testing.T) {
+	for _, command := range []uint16{CMD_XCHG, CMD_CMPXCHG} {
+		machine := newHeadless()
+		if err := machine.Store(0x3000, 7); err != nil {
+			t.Fatal(err)
+		}
+		// XCHG AX 0x3000; HLT
+		if err := machine.Boot(bytecode(FLAG_RI|command, REGISTER_AX, 0x3000, CMD_HLT)); err == nil {
+			t.Errorf("command %02X with an immediate accepted", command)
+		}
+		if value, _ := machine.Load(0x3000); value != 7 {
+			t.Errorf("command %02X with an immediate changed [3000] to %d", command, value)
+		}
+	}
+}
+
+func TestCompareExchange(t *testing.T) {
+	// MOV 4 AX; MOV 0x3000 CX; MOV 9 BX; CMPXCHG BX [CX]; HLT
+	program := bytecode(
+		FLAG_IR|CMD_MOV, 4, REGISTER_AX,
+		FLAG_IR|CMD_MOV, 0x3000, REGISTER_CX,
+		FLAG_IR|CMD_MOV, 9, REGISTER_BX,
+		FLAG_RA|CMD_CMPXCHG, REGISTER_BX, REGISTER_CX,
+		CMD_HLT,
+	)
+	for _, c := range []struct {
+		current        uint16
+		memory, zf, ax uint16
+	}{
+		{4, 9, 1, 4},
+		{6, 6, 0, 6},
+	} {
+		machine := newHeadless()
+		if err := machine.Store(0x3000, c.current); err != nil {
+			t.Fatal(err)
+		}
+		if err := machine.Boot(program); err != nil {
+			t.Fatal(err)
+		}
+		memory, _ := machine.Load(0x3000)
+		zf, _ := machine.Load(ZERO_FLAG)
+		ax, _ := machine.Load(REGISTER_AX)
+		if memory != c.memory || zf != c.zf || ax != c.ax {
+			t.Errorf("CMPXCHG on %d: [3000] = %d, ZF = %d, AX = %d, want %d, %d, %d",
+				c.current, memory, zf, ax, c.memory, c.zf, c.ax)
+		}
+	}
+}
+
+func TestCompareExchangeRegister(t *testing.T) {
+	for _, c := range []struct {
+		current    uint16
+		observed   bool
+		cx, zf, ax uint16
+	}{
+		{4, false, 9, 1, 4},
+		{6, false, 6, 0, 6},
+		{4, true, 9, 1, 4},
+		{6, true, 6, 0, 6},
+	} {
+		machine := newHeadless()
+		if c.observed {
+			if _, err := machine.Observe(REGISTER_CX, REGISTER_CX+1, func(MemoryAccess) {}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// MOV 4 AX; MOV 9 BX; CMPXCHG BX CX; HLT
+		load(t, machine,
+			FLAG_IR|CMD_MOV, 4, REGISTER_AX,
+			FLAG_IR|CMD_MOV, 9, REGISTER_BX,
+			FLAG_RR|CMD_CMPXCHG, REGISTER_BX, REGISTER_CX,
+			CMD_HLT)
+		machine.Store(REGISTER_CX, c.current)
+		if err := machine.run(); err != nil {
+			t.Fatal(err)
+		}
+		cx, _ := machine.Load(REGISTER_CX)
+		zf, _ := machine.Load(ZERO_FLAG)
+		ax, _ := machine.Load(REGISTER_AX)
+		if cx != c.cx || zf != c.zf || ax != c.ax {
+			t.Errorf("CMPXCHG on CX = %d (observed %v): CX = %d, ZF = %d, AX = %d, want %d, %d, %d",
+				c.current, c.observed, cx, zf, ax, c.cx, c.zf, c.ax)
+		}
+	}
+}
+
+// sharedMemory routes the upper half of the address space to memory shared between machines.
+type sharedMemory struct {
+	Memory
+	shared *SyncMemory
+}
+
+func (memory sharedMemory) route(addr uint16) AtomicMemory {
+	if addr >= 0x8000 {
+		return memory.shared
+	}
+	return memory.Memory.(AtomicMemory)
+}
+
+func (memory sharedMemory) Load(addr uint16) (uint16, error) {
+	return memory.route(addr).Load(addr)
+}
+
+func (memory sharedMemory) Store(addr, value uint16) error {
+	return memory.route(addr).Store(addr, value)
+}
+
+func (memory sharedMemory) StoreByte(addr uint16, value byte) error {
+	return memory.route(addr).StoreByte(addr, value)
+}
+
+func (memory sharedMemory) Swap(addr, value uint16) (uint16, error) {
+	return memory.route(addr).Swap(addr, value)
+}
+
+func (memory sharedMemory) CompareAndSwap(addr, old, value uint16) (bool, uint16, error) {
+	return memory.route(addr).CompareAndSwap(addr, old, value)
+}
+
+func TestCompareExchangeConcurrent(t *testing.T) {
+	const rounds = 500
+	// Increment the shared counter at 0x8000 rounds times with a CMPXCHG retry loop
+	program := bytecode(
+		FLAG_IR|CMD_MOV, 0x8000, REGISTER_CX,
+		FLAG_IR|CMD_MOV, rounds, REGISTER_DX,
+		// retry:
+		FLAG_AR|CMD_MOV, REGISTER_CX, REGISTER_AX,
+		FLAG_RR|CMD_MOV, REGISTER_AX, REGISTER_BX,
+		FLAG_R|CMD_INC, REGISTER_BX,
+		FLAG_RA|CMD_CMPXCHG, REGISTER_BX, REGISTER_CX,
+		FLAG_I|CMD_JIF, CODE_BASE+42,
+		FLAG_I|CMD_JMP, CODE_BASE+12,
+		// done:
+		FLAG_R|CMD_DEC, REGISTER_DX,
+		FLAG_RR|CMD_MOV, REGISTER_DX, REGISTER_AX,
+		FLAG_RI|CMD_CMP, REGISTER_AX, 0,
+		FLAG_I|CMD_JIF, CODE_BASE+12,
+		CMD_HLT,
+	)
+	shared := NewSyncMemory(NewMemory(int(MAX_MEMORY) + 1))
+	var group sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		machine := newHeadless()
+		machine.Memory = sharedMemory{machine.Memory, shared}
+		group.Add(1)
+		go func() {
+			defer group.Done()
+			if err := machine.Boot(program); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	group.Wait()
+	if counter, _ := shared.Load(0x8000); counter != 2*rounds {
+		t.Errorf("counter = %d, want %d", counter, 2*rounds)
+	}
+}
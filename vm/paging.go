@@ -0,0 +1,133 @@
+package vm
+
+import "fmt"
+
+// paging translates virtual addresses through a page table in physical memory.
+// The table holds one word per page: the physical page in the high byte and PTE flags in the low byte.
+// The first page holding registers and interrupt vectors is never translated.
+type paging struct {
+	table uint16
+}
+
+// translate maps a virtual address to its physical address.
+// Missing pages and writes to read-only pages raise a page fault.
+func (pages *paging) translate(memory Memory, addr uint16, access Permission) (uint16, error) {
+	if pages.table == 0 || addr < PAGE_SIZE {
+		return addr, nil
+	}
+	entry, err := memory.Load(pages.table + addr/PAGE_SIZE*WORD_SIZE)
+	if err != nil {
+		return 0, err
+	}
+	if entry&PTE_PRESENT == 0 || access&PERM_WRITE != 0 && entry&PTE_WRITABLE == 0 {
+		return 0, &FaultError{Fault: FAULT_PAGE, Address: addr, Access: access}
+	}
+	return entry&PTE_FRAME | addr%PAGE_SIZE, nil
+}
+
+// crossing checks if a word at the address is split across two translated pages.
+func (pages *paging) crossing(addr uint16) bool {
+	return pages.table != 0 && addr%PAGE_SIZE == PAGE_SIZE-1 && addr != MAX_MEMORY
+}
+
+// load fetches a data word from virtual memory.
+func (pages *paging) load(memory Memory, addr uint16) (uint16, error) {
+	return pages.loadAs(memory, addr, PERM_READ)
+}
+
+// fetch loads a command word from virtual memory.
+func (pages *paging) fetch(memory Memory, addr uint16) (uint16, error) {
+	return pages.loadAs(memory, addr, PERM_EXECUTE)
+}
+
+// loadAs fetches a word from virtual memory for a read or execute access.
+// A word at the last address would continue behind the translated page and is out of range.
+func (pages *paging) loadAs(memory Memory, addr uint16, access Permission) (uint16, error) {
+	if addr == MAX_MEMORY {
+		return 0, &OutOfRangeError{addr}
+	}
+	first, err := pages.translate(memory, addr, access)
+	if err != nil {
+		return 0, err
+	}
+	if !pages.crossing(addr) {
+		return loadPhysical(memory, first, access)
+	}
+	second, err := pages.translate(memory, addr+1, access)
+	if err != nil {
+		return 0, err
+	}
+	high, err := loadPhysical(memory, first-1, access)
+	if err != nil {
+		return 0, err
+	}
+	low, err := loadPhysical(memory, second, access)
+	if err != nil {
+		return 0, err
+	}
+	return high<<8 | low>>8, nil
+}
+
+// store puts a word into virtual memory.
+func (pages *paging) store(memory Memory, addr, value uint16) error {
+	if addr == MAX_MEMORY {
+		return &OutOfRangeError{addr}
+	}
+	first, err := pages.translate(memory, addr, PERM_WRITE)
+	if err != nil {
+		return err
+	}
+	if !pages.crossing(addr) {
+		return memory.Store(first, value)
+	}
+	second, err := pages.translate(memory, addr+1, PERM_WRITE)
+	if err != nil {
+		return err
+	}
+	err = memory.StoreByte(first, byte(value>>8))
+	if err != nil {
+		return err
+	}
+	return memory.StoreByte(second, byte(value))
+}
+
+// storeByte puts a byte into virtual memory.
+func (pages *paging) storeByte(memory Memory, addr uint16, value byte) error {
+	physical, err := pages.translate(memory, addr, PERM_WRITE)
+	if err != nil {
+		return err
+	}
+	return memory.StoreByte(physical, value)
+}
+
+// SetPageTable enables paging with the page table at the given physical address.
+// A table address of zero disables paging.
+func (machine *Machine) SetPageTable(table uint16) {
+	machine.paging.table = table
+}
+
+// PageTable returns the physical address of the active page table, or zero if paging is disabled.
+func (machine *Machine) PageTable() uint16 {
+	return machine.paging.table
+}
+
+// PerformSetPageTable switches the address space to the page table given by the argument.
+// Only code running from a privileged page may switch address spaces.
+func (machine *Machine) PerformSetPageTable() error {
+	err := machine.protection.check(machine.current, PERM_PRIVILEGED)
+	if err != nil {
+		return err
+	}
+	table := machine.args[0]
+	if machine.flag == FLAG_R {
+		table, err = machine.Load(machine.args[0])
+		if err != nil {
+			return err
+		}
+	}
+	if int(table)+int(PAGE_COUNT)*int(WORD_SIZE) > int(MAX_MEMORY)+1 {
+		return fmt.Errorf("invalid page table %4.4X", table)
+	}
+	machine.paging.table = table
+	return nil
+}
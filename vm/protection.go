@@ -0,0 +1,191 @@
+package vm
+
+import "fmt"
+
+// Permission is a set of allowed accesses to a memory page.
+type Permission byte
+
+const (
+	PERM_READ Permission = 1 << iota
+	PERM_WRITE
+	PERM_EXECUTE
+	// Code in privileged pages may change page permissions
+	PERM_PRIVILEGED
+
+	PERM_NONE Permission = 0
+	PERM_ALL  Permission = PERM_READ | PERM_WRITE | PERM_EXECUTE | PERM_PRIVILEGED
+	// Permissions of pages not protected explicitly
+	PERM_DEFAULT Permission = PERM_READ | PERM_WRITE | PERM_EXECUTE
+)
+
+func (perm Permission) String() string {
+	flags := []byte("----")
+	for i, c := range "rwxp" {
+		if perm&(1<<uint(i)) != 0 {
+			flags[i] = byte(c)
+		}
+	}
+	return string(flags)
+}
+
+// protection is a per-page permission map.
+// The register file at the start of the first page has its own permission per register,
+// so protecting a register does not affect the other registers or the rest of the page.
+type protection struct {
+	enabled   bool
+	pages     [PAGE_COUNT]Permission
+	registers [REGISTER_FILE_END / WORD_SIZE]Permission
+}
+
+// of returns the permissions of the register or page holding the address.
+func (prot *protection) of(addr uint16) Permission {
+	if addr < REGISTER_FILE_END {
+		return prot.registers[addr/WORD_SIZE]
+	}
+	return prot.pages[addr/PAGE_SIZE]
+}
+
+// check verifies that all bytes of a word allow the access.
+func (prot *protection) check(addr uint16, access Permission) error {
+	err := prot.checkByte(addr, access)
+	if err != nil {
+		return err
+	}
+	return prot.checkByte(addr+1, access)
+}
+
+// checkByte verifies that a single byte allows the access.
+func (prot *protection) checkByte(addr uint16, access Permission) error {
+	if prot.enabled && prot.of(addr)&access != access {
+		return &FaultError{Fault: FAULT_PROTECTION, Address: addr, Access: access}
+	}
+	return nil
+}
+
+// enable turns on the protection with all pages set to PERM_DEFAULT,
+// except for the page holding the privileged address.
+func (prot *protection) enable(privileged uint16) {
+	for i := range prot.pages {
+		prot.pages[i] = PERM_DEFAULT
+	}
+	for i := range prot.registers {
+		prot.registers[i] = PERM_DEFAULT
+	}
+	prot.pages[privileged/PAGE_SIZE] = PERM_ALL
+	prot.enabled = true
+}
+
+// set changes the permissions of all registers and pages overlapping the address range.
+// The first page only changes if the range covers more than the register file.
+func (prot *protection) set(first, last uint16, perm Permission) {
+	for addr := int(first) &^ 1; addr <= int(last) && addr < int(REGISTER_FILE_END); addr += int(WORD_SIZE) {
+		prot.registers[addr/int(WORD_SIZE)] = perm
+	}
+	if last < REGISTER_FILE_END {
+		return
+	}
+	for page := int(first / PAGE_SIZE); page <= int(last/PAGE_SIZE); page++ {
+		prot.pages[page] = perm
+	}
+}
+
+// Protect sets the permissions of all pages overlapping the addresses from first to last (inclusive),
+// registers in the range are protected one by one. Once a range is protected, pages default to PERM_DEFAULT,
+// only the page holding the code base is privileged, and violations raise a protection fault.
+// The bookkeeping of the machine, e.g. advancing the code pointer, is not checked.
+func (machine *Machine) Protect(first, last uint16, perm Permission) {
+	if !machine.protection.enabled {
+		machine.protection.enable(machine.layout.CodeBase)
+	}
+	machine.protection.set(first, last, perm)
+}
+
+// Permissions returns the permissions of the register or page holding the address.
+func (machine *Machine) Permissions(addr uint16) Permission {
+	if !machine.protection.enabled {
+		return PERM_ALL
+	}
+	return machine.protection.of(addr)
+}
+
+// Unprotect disables memory protection.
+func (machine *Machine) Unprotect() {
+	machine.protection.enabled = false
+}
+
+// Load fetches a word from virtual memory if the page is readable.
+func (machine *Machine) Load(addr uint16) (uint16, error) {
+	if machine.direct(addr) {
+		return machine.registers.get(addr), nil
+	}
+	err := machine.protection.check(addr, PERM_READ)
+	if err != nil {
+		return 0, err
+	}
+	return machine.paging.load(machine.Memory, addr)
+}
+
+// Store puts a word into virtual memory if the page is writable.
+func (machine *Machine) Store(addr, value uint16) error {
+	if machine.direct(addr) {
+		machine.registers.set(addr, value)
+		return nil
+	}
+	err := machine.protection.check(addr, PERM_WRITE)
+	if err != nil {
+		return err
+	}
+	return machine.paging.store(machine.Memory, addr, value)
+}
+
+// StoreByte puts a byte into virtual memory if the page is writable.
+func (machine *Machine) StoreByte(addr uint16, value byte) error {
+	err := machine.protection.checkByte(addr, PERM_WRITE)
+	if err != nil {
+		return err
+	}
+	return machine.paging.storeByte(machine.Memory, addr, value)
+}
+
+// checkExecute verifies that code may be fetched from the address.
+func (machine *Machine) checkExecute(addr uint16) error {
+	err := machine.protection.check(addr, PERM_EXECUTE)
+	if err != nil {
+		return err
+	}
+	_, err = machine.paging.translate(machine.Memory, addr, PERM_EXECUTE)
+	return err
+}
+
+// PerformProtect changes the permissions of the page holding the first argument.
+// Both arguments are either registers or immediates (R,R - R,I - I,R - I,I).
+// Only code running from a privileged page may change permissions.
+func (machine *Machine) PerformProtect() error {
+	err := machine.protection.check(machine.current, PERM_PRIVILEGED)
+	if err != nil {
+		return err
+	}
+	addr, perm := machine.args[0], machine.args[1]
+	switch machine.flag {
+	case FLAG_RR:
+		addr, err = machine.Load(addr)
+		if err == nil {
+			perm, err = machine.Load(perm)
+		}
+	case FLAG_RI:
+		addr, err = machine.Load(addr)
+	case FLAG_IR:
+		perm, err = machine.Load(perm)
+	case FLAG_II:
+	default:
+		return fmt.Errorf("unsupported operands %4.4X for PROT", machine.flag)
+	}
+	if err != nil {
+		return err
+	}
+	if perm > uint16(PERM_ALL) {
+		return fmt.Errorf("invalid permissions %4.4X", perm)
+	}
+	machine.Protect(addr, addr, Permission(perm))
+	return nil
+}
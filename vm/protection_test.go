@@ -0,0 +1,123 @@
+package vm
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestStoreByteProtection(t *testing.T) {
+	machine := newHeadless()
+	machine.Protect(0x3000, 0x30FF, PERM_READ)
+	err := machine.StoreByte(0x30FF, 1)
+	if fault, ok := err.(*FaultError); !ok || fault.Fault != FAULT_PROTECTION || fault.Address != 0x30FF {
+		t.Errorf("StoreByte(30FF) = %v", err)
+	}
+	if err := machine.StoreByte(0x3100, 1); err != nil {
+		t.Errorf("StoreByte(3100) = %v", err)
+	}
+}
+
+func TestDefaultPrivilege(t *testing.T) {
+	machine := newHeadless()
+	machine.Protect(0x3000, 0x30FF, PERM_READ)
+	if perm := machine.Permissions(CODE_BASE); perm != PERM_ALL {
+		t.Errorf("code base permissions %v, want %v", perm, PERM_ALL)
+	}
+	if perm := machine.Permissions(CODE_BASE + PAGE_SIZE); perm != PERM_DEFAULT {
+		t.Errorf("default permissions %v, want %v", perm, PERM_DEFAULT)
+	}
+	// MOV 0x3000 AX; PROT AX 7; JMP next; next: PROT AX 3
+	load(t, machine,
+		FLAG_IR|CMD_MOV, 0x3000, REGISTER_AX,
+		FLAG_RI|CMD_PROT, REGISTER_AX, 7,
+		FLAG_I|CMD_JMP, CODE_BASE+PAGE_SIZE)
+	place(t, machine, CODE_BASE+PAGE_SIZE, FLAG_RI|CMD_PROT, REGISTER_AX, 3)
+	err := machine.run()
+	var fault *FaultError
+	if !errors.As(err, &fault) || fault.Fault != FAULT_PROTECTION || fault.Access != PERM_PRIVILEGED || fault.Address != CODE_BASE+PAGE_SIZE {
+		t.Fatalf("PROT outside of the code base page: %v", err)
+	}
+	if perm := machine.Permissions(0x3000); perm != PERM_READ|PERM_WRITE|PERM_EXECUTE {
+		t.Errorf("permissions %v after PROT from the code base page", perm)
+	}
+}
+
+func TestProtectedRegisters(t *testing.T) {
+	machine := newHeadless()
+	machine.Protect(0, 0xFF, PERM_READ|PERM_EXECUTE)
+	// CALL sub; INC CX; HLT; sub: PUSH 7; POP 0x3000; RET
+	err := machine.Boot(bytecode(
+		FLAG_I|CMD_CALL, CODE_BASE+10,
+		FLAG_R|CMD_INC, REGISTER_CX,
+		CMD_HLT,
+		FLAG_I|CMD_PUSH, 7,
+		FLAG_R|CMD_POP, 0x3000,
+		CMD_RET))
+	var fault *FaultError
+	if !errors.As(err, &fault) || fault.Fault != FAULT_PROTECTION || fault.Address != REGISTER_CX {
+		t.Fatalf("INC CX in read-only page: %v", err)
+	}
+	if value, _ := machine.Load(0x3000); value != 7 {
+		t.Errorf("popped %d, want 7", value)
+	}
+	if pointer, _ := machine.Load(CODE_POINTER); pointer != CODE_BASE+8 {
+		t.Errorf("CP = %04X, want %04X", pointer, CODE_BASE+8)
+	}
+	if ticks, _ := machine.Load(TIMER_TICKS); ticks != 4 {
+		t.Errorf("TIMER_TICKS = %d, want 4", ticks)
+	}
+}
+
+func TestProtectCodePointer(t *testing.T) {
+	machine := newHeadless()
+	machine.Protect(CODE_POINTER, CODE_POINTER+1, PERM_READ)
+	if perm := machine.Permissions(REGISTER_AX); perm != PERM_DEFAULT {
+		t.Errorf("AX permissions %v, want %v", perm, PERM_DEFAULT)
+	}
+	if perm := machine.Permissions(REGISTER_FILE_END); perm != PERM_DEFAULT {
+		t.Errorf("permissions %v behind the register file, want %v", perm, PERM_DEFAULT)
+	}
+	// MOV 5 AX; ADD AX 3; MOV 0 BX; JMP next; next: MOV 7 [BX]; HLT
+	err := machine.Boot(bytecode(
+		FLAG_IR|CMD_MOV, 5, REGISTER_AX,
+		FLAG_RI|CMD_ADD, REGISTER_AX, 3,
+		FLAG_IR|CMD_MOV, 0, REGISTER_BX,
+		FLAG_I|CMD_JMP, CODE_BASE+22,
+		FLAG_IA|CMD_MOV, 7, REGISTER_BX,
+		CMD_HLT))
+	var fault *FaultError
+	if !errors.As(err, &fault) || fault.Fault != FAULT_PROTECTION || fault.Address != CODE_POINTER || fault.Access != PERM_WRITE {
+		t.Fatalf("MOV 7 [BX] to the protected CP: %v", err)
+	}
+	if ax, _ := machine.Load(REGISTER_AX); ax != 8 {
+		t.Errorf("AX = %d, want 8", ax)
+	}
+}
+
+func TestProtectOperands(t *testing.T) {
+	for _, c := range []struct {
+		name       string
+		flag       uint16
+		addr, perm uint16
+	}{
+		{"PROT AX BX", FLAG_RR, REGISTER_AX, REGISTER_BX},
+		{"PROT AX 1", FLAG_RI, REGISTER_AX, 1},
+		{"PROT 0x3000 BX", FLAG_IR, 0x3000, REGISTER_BX},
+		{"PROT 0x3000 1", FLAG_II, 0x3000, 1},
+	} {
+		machine := newHeadless()
+		machine.Protect(0x4000, 0x4000, PERM_DEFAULT)
+		// MOV 0x3000 AX; MOV 1 BX; PROT addr perm; HLT
+		err := machine.Boot(bytecode(
+			FLAG_IR|CMD_MOV, 0x3000, REGISTER_AX,
+			FLAG_IR|CMD_MOV, 1, REGISTER_BX,
+			c.flag|CMD_PROT, c.addr, c.perm,
+			CMD_HLT))
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if perm := machine.Permissions(0x3000); perm != PERM_READ {
+			t.Errorf("%s: permissions %v, want %v", c.name, perm, PERM_READ)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package vm
+
+import "sync/atomic"
+
+// registerFile holds the words from CODE_POINTER up to REGISTER_FILE_END and the control
+// registers from IR_BASE up to CONTROL_FILE_END in native fields, indexed by their address.
+// Both windows are mapped onto the bus, so the registers stay readable and writable as memory,
+// while the machine accesses them directly.
+type registerFile struct {
+	words [CONTROL_FILE_END / WORD_SIZE]uint32
+}
+
+// controlRegisters maps the control registers of a register file onto the bus.
+type controlRegisters struct {
+	file *registerFile
+}
+
+// get returns the register at an even address.
+func (file *registerFile) get(addr uint16) uint16 {
+	return uint16(atomic.LoadUint32(&file.words[addr/WORD_SIZE]))
+}
+
+// set changes the register at an even address.
+func (file *registerFile) set(addr, value uint16) {
+	atomic.StoreUint32(&file.words[addr/WORD_SIZE], uint32(value))
+}
+
+// swap exchanges the register at an even address and returns its previous value.
+func (file *registerFile) swap(addr, value uint16) uint16 {
+	return uint16(atomic.SwapUint32(&file.words[addr/WORD_SIZE], uint32(value)))
+}
+
+// compareAndSwap replaces the register at an even address if it equals old and returns its current value.
+func (file *registerFile) compareAndSwap(addr, old, value uint16) (bool, uint16) {
+	word := &file.words[addr/WORD_SIZE]
+	for {
+		current := atomic.LoadUint32(word)
+		if uint16(current) != old {
+			return false, uint16(current)
+		}
+		if atomic.CompareAndSwapUint32(word, current, uint32(value)) {
+			return true, old
+		}
+	}
+}
+
+// byteAt returns a single byte of the register file.
+func (file *registerFile) byteAt(addr uint16) uint16 {
+	word := file.get(addr &^ 1)
+	if addr%WORD_SIZE == 0 {
+		return word >> 8
+	}
+	return word & 0xFF
+}
+
+// load fetches a word from the window of the register file starting at first and ending before end.
+// Words crossing the end of the window are out of range, the bus splits them
+// between the register file and the next device.
+func (file *registerFile) load(first, end, offset uint16) (uint16, error) {
+	addr := first + offset
+	if addr%WORD_SIZE == 0 && addr < end {
+		return file.get(addr), nil
+	}
+	if addr+1 >= end {
+		return 0, &OutOfRangeError{offset}
+	}
+	return file.byteAt(addr)<<8 | file.byteAt(addr+1), nil
+}
+
+// store puts a word into a window of the register file.
+func (file *registerFile) store(first, end, offset, value uint16) error {
+	addr := first + offset
+	if addr%WORD_SIZE == 0 && addr < end {
+		file.set(addr, value)
+		return nil
+	}
+	if addr+1 >= end {
+		return &OutOfRangeError{offset}
+	}
+	file.storeByte(first, end, offset, byte(value>>8))
+	return file.storeByte(first, end, offset+1, byte(value))
+}
+
+// storeByte puts a byte into a window of the register file.
+func (file *registerFile) storeByte(first, end, offset uint16, value byte) error {
+	addr := first + offset
+	if addr >= end {
+		return &OutOfRangeError{offset}
+	}
+	word := &file.words[addr/WORD_SIZE]
+	for {
+		old := atomic.LoadUint32(word)
+		updated := old&0x00FF | uint32(value)<<8
+		if addr%WORD_SIZE != 0 {
+			updated = old&0xFF00 | uint32(value)
+		}
+		if atomic.CompareAndSwapUint32(word, old, updated) {
+			return nil
+		}
+	}
+}
+
+// Load fetches a word from the registers.
+func (file *registerFile) Load(offset uint16) (uint16, error) {
+	return file.load(CODE_POINTER, REGISTER_FILE_END, offset)
+}
+
+// Store puts a word into the registers.
+func (file *registerFile) Store(offset, value uint16) error {
+	return file.store(CODE_POINTER, REGISTER_FILE_END, offset, value)
+}
+
+// StoreByte puts a byte into the registers.
+func (file *registerFile) StoreByte(offset uint16, value byte) error {
+	return file.storeByte(CODE_POINTER, REGISTER_FILE_END, offset, value)
+}
+
+// Load fetches a word from the control registers.
+func (control controlRegisters) Load(offset uint16) (uint16, error) {
+	return control.file.load(IR_BASE, CONTROL_FILE_END, offset)
+}
+
+// Store puts a word into the control registers.
+func (control controlRegisters) Store(offset, value uint16) error {
+	return control.file.store(IR_BASE, CONTROL_FILE_END, offset, value)
+}
+
+// StoreByte puts a byte into the control registers.
+func (control controlRegisters) StoreByte(offset uint16, value byte) error {
+	return control.file.storeByte(IR_BASE, CONTROL_FILE_END, offset, value)
+}
+
+// direct checks if an access may bypass the memory and use the register file.
+func (machine *Machine) direct(addr uint16) bool {
+	return !machine.protection.enabled && machine.native(addr)
+}
+
+// native checks if a register may be accessed in its native field.
+// Devices mapped over the register file by the host disable the fast path.
+func (machine *Machine) native(addr uint16) bool {
+	inside := addr < REGISTER_FILE_END || addr >= IR_BASE && addr < CONTROL_FILE_END
+	return inside && addr%WORD_SIZE == 0 && !machine.observed && machine.ownsRegisters()
+}
+
+// loadRegister fetches a register or device word for the bookkeeping of the machine itself,
+// e.g. the code pointer or the timer registers. Memory protection only applies to the
+// accesses of the program, the first page is never translated.
+func (machine *Machine) loadRegister(addr uint16) (uint16, error) {
+	if machine.native(addr) {
+		return machine.registers.get(addr), nil
+	}
+	return machine.Memory.Load(addr)
+}
+
+// storeRegister puts a register or device word for the bookkeeping of the machine itself.
+func (machine *Machine) storeRegister(addr, value uint16) error {
+	if machine.native(addr) {
+		machine.registers.set(addr, value)
+		return nil
+	}
+	return machine.Memory.Store(addr, value)
+}
+
+// ownsRegisters checks if the register file alone is mapped at the register addresses.
+// The result is cached until the devices on the bus change, the bus has changed at least
+// once when the register file is mapped, so the initial version of zero is never cached.
+func (machine *Machine) ownsRegisters() bool {
+	if version := machine.bus.version(); machine.registerVersion != version {
+		machine.registersOwned = machine.bus.owns(CODE_POINTER, REGISTER_FILE_END-1, machine.registerMapping) &&
+			machine.bus.owns(IR_BASE, CONTROL_FILE_END-1, machine.controlMapping)
+		machine.registerVersion = version
+	}
+	return machine.registersOwned
+}
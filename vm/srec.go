@@ -0,0 +1,118 @@
+package vm
+
+import (
+	"fmt"
+	"strings"
+)
+
+// S-record data bytes per record
+const srecRecordSize = 0x10
+
+// decodeSRecord parses Motorola S-records with 16, 24 or 32 bit addresses.
+func decodeSRecord(data []byte, base uint16, banked bool) (Image, error) {
+	builder := imageBuilder{banked: banked}
+	image := Image{Entry: base}
+	for number, line := range recordLines(data) {
+		if len(line) < 2 || line[0] != 'S' {
+			return Image{}, fmt.Errorf("line %d: missing record mark", number+1)
+		}
+		record, err := parseHex(line[2:])
+		if err != nil {
+			return Image{}, fmt.Errorf("line %d: %v", number+1, err)
+		}
+		if len(record) < 1 || len(record) != int(record[0])+1 {
+			return Image{}, fmt.Errorf("line %d: invalid record length", number+1)
+		}
+		var sum byte
+		for _, b := range record[:len(record)-1] {
+			sum += b
+		}
+		if ^sum != record[len(record)-1] {
+			return Image{}, fmt.Errorf("line %d: checksum mismatch", number+1)
+		}
+
+		kind := line[1]
+		var size int
+		switch kind {
+		case '0', '1', '5', '9':
+			size = 2
+		case '2', '6', '8':
+			size = 3
+		case '3', '7':
+			size = 4
+		default:
+			return Image{}, fmt.Errorf("line %d: unknown record type S%c", number+1, kind)
+		}
+		if len(record) < size+2 {
+			return Image{}, fmt.Errorf("line %d: invalid record length", number+1)
+		}
+		var addr uint32
+		for _, b := range record[1 : size+1] {
+			addr = addr<<8 | uint32(b)
+		}
+		payload := record[size+1 : len(record)-1]
+		switch kind {
+		case '1', '2', '3':
+			if err := builder.add(addr, payload); err != nil {
+				return Image{}, fmt.Errorf("line %d: %v", number+1, err)
+			}
+		case '7', '8', '9':
+			image.Entry = uint16(addr)
+		}
+	}
+	image.Blocks = builder.blocks
+	return image, nil
+}
+
+// writeSRecord appends a record with its byte count and checksum.
+func writeSRecord(output *strings.Builder, kind byte, size int, addr uint32, payload []byte) {
+	record := []byte{byte(size + len(payload) + 1)}
+	for i := size - 1; i >= 0; i-- {
+		record = append(record, byte(addr>>uint(8*i)))
+	}
+	record = append(record, payload...)
+	var sum byte
+	for _, b := range record {
+		sum += b
+	}
+	record = append(record, ^sum)
+	fmt.Fprintf(output, "S%c%X\n", kind, record)
+}
+
+// encodeSRecord serializes an image as S-records, using 24 or 32 bit linear addresses for banks.
+func encodeSRecord(image Image) []byte {
+	var output strings.Builder
+	var highest uint32
+	for _, block := range image.Blocks {
+		if addr := linear(block.Bank, block.Address); addr > highest {
+			highest = addr
+		}
+	}
+	kind, terminator, size := byte('1'), byte('9'), 2
+	switch {
+	case highest > 0xFFFFFF:
+		kind, terminator, size = '3', '7', 4
+	case highest > 0xFFFF:
+		kind, terminator, size = '2', '8', 3
+	}
+
+	writeSRecord(&output, '0', 2, 0, []byte("govm"))
+	count := 0
+	for _, block := range image.Blocks {
+		for start := 0; start < len(block.Data); start += srecRecordSize {
+			end := start + srecRecordSize
+			if end > len(block.Data) {
+				end = len(block.Data)
+			}
+			writeSRecord(&output, kind, size, linear(block.Bank, block.Address+uint16(start)), block.Data[start:end])
+			count++
+		}
+	}
+	if count <= 0xFFFF {
+		writeSRecord(&output, '5', 2, uint32(count), nil)
+	} else {
+		writeSRecord(&output, '6', 3, uint32(count), nil)
+	}
+	writeSRecord(&output, terminator, size, uint32(image.Entry), nil)
+	return []byte(output.String())
+}
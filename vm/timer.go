@@ -0,0 +1,69 @@
+package vm
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Timer is a programmable interval timer.
+// It counts machine cycles in a free-running tick counter and raises the timer
+// interrupt whenever the programmed period in cycles or milliseconds has elapsed.
+type Timer struct {
+	ticks   uint32
+	elapsed uint16
+	last    time.Time
+}
+
+// Ticks returns the free-running tick counter.
+// It is safe to call from other goroutines while the machine runs.
+func (timer *Timer) Ticks() uint16 {
+	return uint16(atomic.LoadUint32(&timer.ticks))
+}
+
+// reset clears the tick counter and restarts the period.
+func (timer *Timer) reset() {
+	atomic.StoreUint32(&timer.ticks, 0)
+	timer.elapsed = 0
+	timer.last = time.Now()
+}
+
+// step advances the timer by one machine cycle.
+func (timer *Timer) step(machine *Machine) error {
+	ticks := uint16(atomic.AddUint32(&timer.ticks, 1))
+	err := machine.storeRegister(TIMER_TICKS, ticks)
+	if err != nil {
+		return err
+	}
+	control, err := machine.loadRegister(TIMER_CONTROL)
+	if err != nil {
+		return err
+	}
+	period, err := machine.loadRegister(TIMER_PERIOD)
+	if err != nil {
+		return err
+	}
+	if control&TIMER_ENABLE == 0 || period == 0 {
+		// the period starts once the timer is enabled
+		timer.elapsed = 0
+		timer.last = time.Time{}
+		return nil
+	}
+
+	if control&TIMER_WALLCLOCK != 0 {
+		if timer.last.IsZero() {
+			timer.last = time.Now()
+		}
+		if time.Since(timer.last) < time.Duration(period)*time.Millisecond {
+			return nil
+		}
+		timer.last = time.Now()
+	} else {
+		timer.elapsed++
+		if timer.elapsed < period {
+			return nil
+		}
+		timer.elapsed = 0
+	}
+	machine.Interrupt(IR_TIMER_EXPIRED, VECTOR_TIMER)
+	return nil
+}
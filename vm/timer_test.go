@@ -0,0 +1,89 @@
+package vm
+
+import (
+	"testing"
+	"time"
+)
+
+// tick steps the timer once and reports if it raised an interrupt.
+func tick(t *testing.T, machine *Machine) bool {
+	if err := machine.timer.step(machine); err != nil {
+		t.Fatal(err)
+	}
+	raised := machine.Interrupts().Pending() != 0
+	machine.interrupts = NewInterruptController()
+	return raised
+}
+
+func TestTimerCycles(t *testing.T) {
+	machine := newHeadless()
+	if err := machine.initialize(); err != nil {
+		t.Fatal(err)
+	}
+	machine.Store(TIMER_PERIOD, 3)
+	machine.Store(TIMER_CONTROL, TIMER_ENABLE)
+	for i, want := range []bool{false, false, true, false, false, true, false} {
+		if got := tick(t, machine); got != want {
+			t.Errorf("cycle %d: raised %v, want %v", i+1, got, want)
+		}
+	}
+	machine.Store(TIMER_CONTROL, 0)
+	for i := 0; i < 5; i++ {
+		if tick(t, machine) {
+			t.Errorf("disabled timer raised an interrupt")
+		}
+	}
+	ticks, _ := machine.Load(TIMER_TICKS)
+	if ticks != 12 || machine.Timer().Ticks() != 12 {
+		t.Errorf("ticks = %d, %d, want 12", ticks, machine.Timer().Ticks())
+	}
+}
+
+func TestTimerWallClock(t *testing.T) {
+	machine := newHeadless()
+	if err := machine.initialize(); err != nil {
+		t.Fatal(err)
+	}
+	machine.Store(TIMER_PERIOD, 20)
+	machine.Store(TIMER_CONTROL, TIMER_ENABLE|TIMER_WALLCLOCK)
+	if tick(t, machine) {
+		t.Error("raised before the period elapsed")
+	}
+	time.Sleep(25 * time.Millisecond)
+	if !tick(t, machine) {
+		t.Error("not raised after the period elapsed")
+	}
+	if tick(t, machine) {
+		t.Error("raised again before the next period elapsed")
+	}
+}
+
+func TestTimerConcurrentTicks(t *testing.T) {
+	machine := newHeadless()
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				machine.Timer().Ticks()
+			}
+		}
+	}()
+	defer close(done)
+	// loop: INC AX; MOV AX DX; CMP DX 0x1000; JIF loop; HLT
+	code := bytecode(
+		FLAG_R|CMD_INC, REGISTER_AX,
+		FLAG_RR|CMD_MOV, REGISTER_AX, REGISTER_DX,
+		FLAG_RI|CMD_CMP, REGISTER_DX, 0x1000,
+		FLAG_I|CMD_JIF, CODE_BASE,
+		CMD_HLT,
+	)
+	if err := machine.Boot(code); err != nil {
+		t.Fatal(err)
+	}
+	if ticks := machine.Timer().Ticks(); ticks < 0x1000 {
+		t.Errorf("ticks = %d after the loop", ticks)
+	}
+}